@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
+)
+
+// strategies used to copy the data of a regular file during copyup
+const (
+	COPY_REFLINK = "reflink"
+	COPY_RANGE   = "copy_file_range"
+	COPY_SPARSE  = "sparse"
+)
+
+// returns the number of bytes copied, also on error
+func copyrange(out *os.File, in *os.File, off int64, length int64) (int64, error) {
+	var copied int64
+	buf := make([]byte, 128*1024)
+	for length > 0 {
+		n := len(buf)
+		if int64(n) > length {
+			n = int(length)
+		}
+		n, err := in.ReadAt(buf[:n], off)
+		if n > 0 {
+			if _, err := out.WriteAt(buf[:n], off); err != nil {
+				return copied, err
+			}
+			copied += int64(n)
+		}
+		if err == io.EOF {
+			return copied, nil
+		}
+		if err != nil {
+			return copied, err
+		}
+		off += int64(n)
+		length -= int64(n)
+	}
+	return copied, nil
+}
+
+// copies the contents of in to out. A reflink is tried first when both are
+// on the same filesystem, otherwise only the data extents are copied so
+// that holes are kept. Returns the strategy that was used and the bytes of
+// data actually copied, none for a reflink.
+func copydata(out *os.File, in *os.File, samefs bool) (string, int64, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(in.Fd()), &stat); err != nil {
+		return "", 0, err
+	}
+	if samefs {
+		if err := ficlone(out, in); err == nil {
+			return COPY_REFLINK, 0, nil
+		}
+	}
+	userange := samefs
+	strategy := COPY_SPARSE
+	if userange {
+		strategy = COPY_RANGE
+	}
+	fd := int(in.Fd())
+	var off, copied int64
+	for off < stat.Size {
+		data, err := syscall.Seek(fd, off, SEEK_DATA)
+		if err == syscall.ENXIO {
+			// only a hole is left
+			break
+		}
+		hole := stat.Size
+		if err != nil {
+			// SEEK_DATA is not supported, copy the rest as data
+			data = off
+		} else if h, err := syscall.Seek(fd, data, SEEK_HOLE); err == nil {
+			hole = h
+		}
+		if userange {
+			n, err := copyfilerange(out, in, data, hole-data)
+			copied += n
+			switch err {
+			case nil:
+				data = hole
+			case syscall.ENOSYS, syscall.EXDEV, syscall.EINVAL, syscall.EOPNOTSUPP:
+				// the rest is copied by hand from where it stopped, the
+				// strategy stays copy_file_range once it copied anything
+				userange = false
+				data += n
+				if copied == 0 {
+					strategy = COPY_SPARSE
+				}
+			default:
+				return "", copied, err
+			}
+		}
+		if data < hole {
+			n, err := copyrange(out, in, data, hole-data)
+			copied += n
+			if err != nil {
+				return "", copied, err
+			}
+		}
+		off = hole
+	}
+	// extends the file over a trailing hole
+	if err := out.Truncate(stat.Size); err != nil {
+		return "", copied, err
+	}
+	return strategy, copied, nil
+}
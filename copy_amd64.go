@@ -0,0 +1,3 @@
+package main
+
+const SYS_COPY_FILE_RANGE = 326
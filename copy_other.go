@@ -0,0 +1,21 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reflinks and copy_file_range are only wired up on amd64 and arm64,
+// copydata falls back to the sparse copy elsewhere
+
+func ficlone(out *os.File, in *os.File) error {
+	return syscall.ENOSYS
+}
+
+// returns the number of bytes copied, also on error
+func copyfilerange(out *os.File, in *os.File, off int64, length int64) (int64, error) {
+	return 0, syscall.ENOSYS
+}
@@ -0,0 +1,43 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// the asm-generic ioctl encoding, SYS_COPY_FILE_RANGE comes from the
+// copy_$GOARCH.go files
+const FICLONE = 0x40049409
+
+func ficlone(out *os.File, in *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), FICLONE, in.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// returns the number of bytes copied, also on error
+func copyfilerange(out *os.File, in *os.File, off int64, length int64) (int64, error) {
+	var copied int64
+	for length > 0 {
+		inoff := off
+		outoff := off
+		n, _, errno := syscall.Syscall6(SYS_COPY_FILE_RANGE, in.Fd(), uintptr(unsafe.Pointer(&inoff)), out.Fd(), uintptr(unsafe.Pointer(&outoff)), uintptr(length), 0)
+		if errno != 0 {
+			return copied, errno
+		}
+		if n == 0 {
+			// source got shorter
+			return copied, nil
+		}
+		copied += int64(n)
+		off += int64(n)
+		length -= int64(n)
+	}
+	return copied, nil
+}
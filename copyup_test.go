@@ -0,0 +1,298 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	Path "path"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// a constor on two fresh layers, layer1 is the read-only one
+func newtestconstor(t *testing.T, whiteout string) *Constor {
+	opts := defaultoptions()
+	opts.whiteout = whiteout
+	for i := 0; i < 2; i++ {
+		layer, err := ioutil.TempDir("", "constor")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.layers = append(opts.layers, layer)
+	}
+	logf, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	constor := NewConstor(opts, logf)
+	if err := constor.preparelayers(); err != nil {
+		t.Fatal(err)
+	}
+	// the kernel starts out with a GETATTR of the root, it finds its layer
+	root := fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+	if code := constor.GetAttr(&fuse.GetAttrIn{InHeader: root}, &fuse.AttrOut{}); !code.Ok() {
+		t.Fatal(code)
+	}
+	return constor
+}
+
+func removetestconstor(constor *Constor) {
+	for _, layer := range constor.layers {
+		os.RemoveAll(layer)
+	}
+	constor.logf.Close()
+}
+
+// mknod, chmod and chown on special files need root
+func needroot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+}
+
+// creates the object id in layer li with mknod and copies it up
+func mknodcopyup(t *testing.T, constor *Constor, li int, mode uint32, rdev int) (string, error) {
+	id := newuuid().String()
+	if err := syscall.Mknod(constor.getPath(li, id), mode, rdev); err != nil {
+		t.Fatal(err)
+	}
+	inode := NewInode(constor, id)
+	inode.setlayer(li)
+	return id, constor.copyup(inode)
+}
+
+func TestCopyupSpecial(t *testing.T) {
+	needroot(t)
+	for _, whiteout := range []string{WHITEOUT_LEGACY, WHITEOUT_STRICT} {
+		constor := newtestconstor(t, whiteout)
+		defer removetestconstor(constor)
+		specials := []struct {
+			mode uint32
+			rdev int
+		}{
+			{syscall.S_IFCHR | 0600, 1<<8 | 3},
+			{syscall.S_IFCHR | 0600, 1 << 8},
+			{syscall.S_IFCHR | 0600, 3},
+			{syscall.S_IFBLK | 0600, 7<<8 | 0},
+			{syscall.S_IFIFO | 0644, 0},
+			{syscall.S_IFSOCK | 0600, 0},
+		}
+		for _, special := range specials {
+			id, err := mknodcopyup(t, constor, 1, special.mode, special.rdev)
+			if err != nil {
+				t.Fatalf("%s: copyup of %o %d:%d : %s", whiteout, special.mode, special.rdev>>8, special.rdev&0xff, err)
+			}
+			path := constor.getPath(0, id)
+			stat := syscall.Stat_t{}
+			if err := syscall.Lstat(path, &stat); err != nil {
+				t.Fatalf("%s: %s", whiteout, err)
+			}
+			if stat.Mode != special.mode || int(stat.Rdev) != special.rdev {
+				t.Errorf("%s: copied up %o %d, want %o %d", whiteout, stat.Mode, stat.Rdev, special.mode, special.rdev)
+			}
+			if constor.isdeleted(path, nil) {
+				t.Errorf("%s: copied up %o %d is a whiteout", whiteout, special.mode, special.rdev)
+			}
+		}
+	}
+}
+
+// a whiteout never gets copied up, and a copied up device never becomes one
+func TestCopyupWhiteout(t *testing.T) {
+	needroot(t)
+	for _, whiteout := range []string{WHITEOUT_LEGACY, WHITEOUT_STRICT} {
+		constor := newtestconstor(t, whiteout)
+		defer removetestconstor(constor)
+
+		id := newuuid().String()
+		path := constor.getPath(1, id)
+		if err := constor.setdeleted(path); err != nil {
+			t.Fatal(err)
+		}
+		if !constor.isdeleted(path, nil) {
+			t.Fatalf("%s: setdeleted did not make a whiteout", whiteout)
+		}
+		inode := NewInode(constor, id)
+		inode.setlayer(1)
+		if err := constor.copyup(inode); err != syscall.ENOENT {
+			t.Errorf("%s: copyup of a whiteout returned %v", whiteout, err)
+		}
+		if _, err := os.Lstat(constor.getPath(0, id)); !os.IsNotExist(err) {
+			t.Errorf("%s: copyup of a whiteout left %s", whiteout, constor.getPath(0, id))
+		}
+
+		// a real 0:0 device is only told apart from a whiteout in strict mode
+		id, err := mknodcopyup(t, constor, 1, syscall.S_IFCHR|0600, 0)
+		if whiteout == WHITEOUT_LEGACY {
+			if err != syscall.ENOENT {
+				t.Errorf("%s: copyup of a 0:0 device returned %v", whiteout, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: copyup of a 0:0 device : %s", whiteout, err)
+		}
+		path = constor.getPath(0, id)
+		if constor.isdeleted(path, nil) {
+			t.Errorf("%s: copied up 0:0 device is a whiteout", whiteout)
+		}
+		if deleted, err := Lgetxattr(path, DELXATTR); err == nil && len(deleted) != 0 {
+			t.Errorf("%s: copied up 0:0 device carries %s", whiteout, DELXATTR)
+		}
+		// a whiteout set over it later is one again
+		entry := Path.Join(constor.getPath(0, ROOTID), "dev")
+		if err := constor.mkplaceholder(entry, id, syscall.S_IFCHR|0600); err != nil {
+			t.Fatal(err)
+		}
+		if constor.isdeleted(entry, nil) {
+			t.Errorf("%s: entry of a 0:0 device is a whiteout", whiteout)
+		}
+		if err := constor.setdeleted(entry); err != nil {
+			t.Fatal(err)
+		}
+		if !constor.isdeleted(entry, nil) {
+			t.Errorf("%s: setdeleted over a 0:0 device entry is no whiteout", whiteout)
+		}
+	}
+}
+
+// the chown of the copy must not drop setuid and setgid bits
+func TestCopyupSetid(t *testing.T) {
+	needroot(t)
+	constor := newtestconstor(t, WHITEOUT_LEGACY)
+	defer removetestconstor(constor)
+	for _, mode := range []uint32{04755, 02755, 06750} {
+		id := newuuid().String()
+		path := constor.getPath(1, id)
+		if err := ioutil.WriteFile(path, []byte("binary"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Chown(path, 12, 34); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+		inode := NewInode(constor, id)
+		inode.setlayer(1)
+		if err := constor.copyup(inode); err != nil {
+			t.Fatal(err)
+		}
+		stat := syscall.Stat_t{}
+		if err := syscall.Lstat(constor.getPath(0, id), &stat); err != nil {
+			t.Fatal(err)
+		}
+		if stat.Mode != syscall.S_IFREG|mode || stat.Uid != 12 || stat.Gid != 34 {
+			t.Errorf("copied up %o %d:%d, want %o 12:34", stat.Mode, stat.Uid, stat.Gid, syscall.S_IFREG|mode)
+		}
+	}
+}
+
+// without atomic_o_trunc the kernel opens a file for writing and truncates
+// it with a SETATTR after, truncate(2) sends the SETATTR alone. Neither
+// copies the data that is thrown away.
+func TestCopyupTruncate(t *testing.T) {
+	needroot(t)
+	constor := newtestconstor(t, WHITEOUT_LEGACY)
+	defer removetestconstor(constor)
+	if err := os.Mkdir(constor.getPath(1, ROOTID), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mklowerfile(t, constor, "f")
+	mklowerfile(t, constor, "g")
+	root := fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+
+	var f fuse.EntryOut
+	if code := constor.Lookup(&root, "f", &f); !code.Ok() {
+		t.Fatal(code)
+	}
+	fh := fuse.InHeader{NodeId: f.NodeId}
+	var o fuse.OpenOut
+	if code := constor.Open(&fuse.OpenIn{InHeader: fh, Flags: uint32(os.O_WRONLY)}, &o); !code.Ok() {
+		t.Fatal(code)
+	}
+	defer constor.Release(&fuse.ReleaseIn{Fh: o.Fh})
+	fid := constor.inodemap.findInodePtr(f.NodeId).id
+	if _, err := os.Lstat(constor.getPath(0, fid)); !os.IsNotExist(err) {
+		t.Fatalf("open for writing copied up f : %v", err)
+	}
+	in := &fuse.SetAttrIn{}
+	in.NodeId = f.NodeId
+	in.Valid = fuse.FATTR_FH | fuse.FATTR_SIZE
+	in.Fh = o.Fh
+	if code := constor.SetAttr(in, &fuse.AttrOut{}); !code.Ok() {
+		t.Fatal(code)
+	}
+
+	var g fuse.EntryOut
+	if code := constor.Lookup(&root, "g", &g); !code.Ok() {
+		t.Fatal(code)
+	}
+	in = &fuse.SetAttrIn{}
+	in.NodeId = g.NodeId
+	in.Valid = fuse.FATTR_SIZE
+	if code := constor.SetAttr(in, &fuse.AttrOut{}); !code.Ok() {
+		t.Fatal(code)
+	}
+	gid := constor.inodemap.findInodePtr(g.NodeId).id
+
+	for _, id := range []string{fid, gid} {
+		stat := syscall.Stat_t{}
+		if err := syscall.Lstat(constor.getPath(0, id), &stat); err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size != 0 {
+			t.Errorf("truncated copy of %s has %d bytes", id, stat.Size)
+		}
+		if data, _ := ioutil.ReadFile(constor.getPath(1, id)); string(data) != "lower data" {
+			t.Errorf("lower %s changed to %q", id, data)
+		}
+	}
+	copyups := constor.ctlcopyups()
+	if copyups["truncate"] != 2 || len(copyups) != 1 {
+		t.Errorf("copyups %v, want 2 truncate", copyups)
+	}
+}
+
+// a write or truncate through a read-only fd of an unlinked lower file
+// fails without copying it to the orphans
+func TestOrphanupReadOnly(t *testing.T) {
+	needroot(t)
+	constor := newtestconstor(t, WHITEOUT_LEGACY)
+	defer removetestconstor(constor)
+	if err := os.Mkdir(constor.getPath(1, ROOTID), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mklowerfile(t, constor, "f")
+	root := fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+	var f fuse.EntryOut
+	if code := constor.Lookup(&root, "f", &f); !code.Ok() {
+		t.Fatal(code)
+	}
+	fh := fuse.InHeader{NodeId: f.NodeId}
+	var o fuse.OpenOut
+	if code := constor.Open(&fuse.OpenIn{InHeader: fh, Flags: uint32(os.O_RDONLY)}, &o); !code.Ok() {
+		t.Fatal(code)
+	}
+	defer constor.Release(&fuse.ReleaseIn{Fh: o.Fh})
+	id := constor.inodemap.findInodePtr(f.NodeId).id
+	if code := constor.Unlink(&root, "f"); !code.Ok() {
+		t.Fatal(code)
+	}
+
+	if _, code := constor.Write(&fuse.WriteIn{InHeader: fh, Fh: o.Fh}, []byte("data")); code != fuse.EBADF {
+		t.Errorf("write through a read-only fd returned %v", code)
+	}
+	in := &fuse.SetAttrIn{}
+	in.NodeId = f.NodeId
+	in.Valid = fuse.FATTR_FH | fuse.FATTR_SIZE
+	in.Fh = o.Fh
+	in.Size = 4
+	if code := constor.SetAttr(in, &fuse.AttrOut{}); code != fuse.EINVAL {
+		t.Errorf("truncate through a read-only fd returned %v", code)
+	}
+	if _, err := os.Lstat(constor.orphanPath(id)); !os.IsNotExist(err) {
+		t.Errorf("%s was copied to the orphans : %v", id, err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The control socket serves JSON over HTTP on a unix socket:
+//
+//	GET /status              everything below in one document
+//	GET /layers              the layer stack, layer0 first
+//	GET /inodes              number of inodes in the inodemap
+//	GET /fds                 open files and directories
+//	GET /copyups             copyup counters per strategy, the same as
+//	                         constor_copyups_total on /metrics
+//	GET /metrics             Prometheus metrics, see metrics.go
+//	GET|PUT /loglevel        log level, PUT takes the level as body
+//	GET|PUT /logops          operations logged below error, PUT takes
+//	                         "OP:OP..." as body
+//	PUT /sweep               runs sweep, takes quarantine or remove as body
+//	                         (default quarantine)
+
+const CTLUSAGE = `Usage: constor ctl SOCKET COMMAND [ARG]
+
+Commands:
+  status              show everything below
+  layers              show the layer stack
+  inodes              show the number of inodes in use
+  fds                 show the open files and directories
+  copyups             show the copyup counters
+  loglevel [LEVEL]    show or set the log level
+  logops [OP:OP...]   show or set the operations logged below error,
+                      an empty list logs all of them
+  sweep [remove]      quarantine or remove the objects no entry refers to
+                      and drop the entries whose object is missing
+`
+
+type ctlfd struct {
+	Fh    uint64 `json:"fh"`
+	Id    string `json:"id"`
+	Layer int    `json:"layer"`
+	Pid   uint32 `json:"pid"`
+	Flags int    `json:"flags"`
+	Dir   bool   `json:"dir"`
+}
+
+type ctlstatus struct {
+	Layers   []string          `json:"layers"`
+	Inodes   int               `json:"inodes"`
+	Fds      []ctlfd           `json:"fds"`
+	Copyups  map[string]uint64 `json:"copyups"`
+	LogLevel string            `json:"loglevel"`
+	LogOps   []string          `json:"logops"`
+}
+
+func (constor *Constor) ctlinodes() int {
+	constor.Lock()
+	defer constor.Unlock()
+	return len(constor.inodemap.ptrmap)
+}
+
+func (constor *Constor) ctlfds() []ctlfd {
+	constor.Lock()
+	defer constor.Unlock()
+	fds := []ctlfd{}
+	for ptr, F := range constor.fdmap {
+		F.RLock()
+		fds = append(fds, ctlfd{
+			Fh:    uint64(ptr),
+			Id:    F.id,
+			Layer: F.layer,
+			Pid:   F.pid,
+			Flags: F.flags,
+			Dir:   F.stream != nil,
+		})
+		F.RUnlock()
+	}
+	sort.Slice(fds, func(i, j int) bool { return fds[i].Fh < fds[j].Fh })
+	return fds
+}
+
+func (constor *Constor) ctlcopyups() map[string]uint64 {
+	return constor.metrics.copyupcounts()
+}
+
+func (constor *Constor) ctlstatus() *ctlstatus {
+	return &ctlstatus{
+		Layers:   constor.layers,
+		Inodes:   constor.ctlinodes(),
+		Fds:      constor.ctlfds(),
+		Copyups:  constor.ctlcopyups(),
+		LogLevel: constor.getloglevel(),
+		LogOps:   constor.getlogops(),
+	}
+}
+
+func writejson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(append(buf, '\n'))
+}
+
+func (constor *Constor) ctlhandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writejson(w, constor.ctlstatus())
+	})
+	mux.HandleFunc("/layers", func(w http.ResponseWriter, r *http.Request) {
+		writejson(w, constor.layers)
+	})
+	mux.HandleFunc("/inodes", func(w http.ResponseWriter, r *http.Request) {
+		writejson(w, constor.ctlinodes())
+	})
+	mux.HandleFunc("/fds", func(w http.ResponseWriter, r *http.Request) {
+		writejson(w, constor.ctlfds())
+	})
+	mux.HandleFunc("/copyups", func(w http.ResponseWriter, r *http.Request) {
+		writejson(w, constor.ctlcopyups())
+	})
+	mux.HandleFunc("/metrics", constor.metricshandler)
+	mux.HandleFunc("/loglevel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			body, _ := ioutil.ReadAll(r.Body)
+			if err := constor.setloglevel(strings.TrimSpace(string(body))); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			constor.info("log level set to %s", constor.getloglevel())
+		}
+		writejson(w, constor.getloglevel())
+	})
+	mux.HandleFunc("/sweep", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			http.Error(w, "sweep needs PUT", http.StatusMethodNotAllowed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mode := strings.TrimSpace(string(body))
+		if mode == "" {
+			mode = SWEEP_QUARANTINE
+		}
+		if mode != SWEEP_QUARANTINE && mode != SWEEP_REMOVE {
+			http.Error(w, fmt.Sprintf("unknown sweep mode %q", mode), http.StatusBadRequest)
+			return
+		}
+		report, err := constor.sweep(mode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writejson(w, report)
+	})
+	mux.HandleFunc("/logops", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			body, _ := ioutil.ReadAll(r.Body)
+			constor.setlogops(splitlist(strings.TrimSpace(string(body))))
+		}
+		writejson(w, constor.getlogops())
+	})
+	return mux
+}
+
+// serves the control API on the unix socket path until ctl is closed
+func (constor *Constor) servectl(path string) error {
+	// a socket left behind by a crash
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	constor.ctl = l
+	go func() {
+		if err := http.Serve(l, constor.ctlhandler()); err != nil {
+			constor.info("control socket closed : %s", err)
+		}
+	}()
+	return nil
+}
+
+func ctlmain(args []string) int {
+	if len(args) < 2 || len(args) > 3 {
+		fmt.Fprint(os.Stderr, CTLUSAGE)
+		return 1
+	}
+	socket := args[0]
+	cmd := args[1]
+	switch cmd {
+	case "status", "layers", "inodes", "fds", "copyups", "loglevel", "logops", "sweep":
+	default:
+		fmt.Fprintf(os.Stderr, "constor ctl: unknown command %q\n\n%s", cmd, CTLUSAGE)
+		return 1
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+	url := "http://constor/" + cmd
+	var resp *http.Response
+	var err error
+	if len(args) == 3 || cmd == "sweep" {
+		if cmd != "loglevel" && cmd != "logops" && cmd != "sweep" {
+			fmt.Fprintf(os.Stderr, "constor ctl: %s takes no argument\n", cmd)
+			return 1
+		}
+		body := ""
+		if len(args) == 3 {
+			body = args[2]
+		}
+		req, err := http.NewRequest("PUT", url, strings.NewReader(body))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "constor ctl: %s\n", err)
+			return 1
+		}
+		resp, err = client.Do(req)
+	} else {
+		resp, err = client.Get(url)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "constor ctl: %s\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "constor ctl: %s\n", err)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "constor ctl: %s", body)
+		return 1
+	}
+	os.Stdout.Write(body)
+	return 0
+}
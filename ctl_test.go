@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	Path "path"
+	"strings"
+	"testing"
+)
+
+// sends method path with body to the control socket and decodes the
+// reply into v
+func ctlrequest(t *testing.T, socket string, method string, path string, body string, v interface{}) int {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://constor"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.Unmarshal(buf, v); err != nil {
+			t.Fatalf("%s %s: %q : %s", method, path, buf, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestCtl(t *testing.T) {
+	needroot(t)
+	constor := newtestconstor(t, WHITEOUT_LEGACY)
+	defer removetestconstor(constor)
+	dir, err := ioutil.TempDir("", "constor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := Path.Join(dir, "ctl.sock")
+	if err := constor.servectl(socket); err != nil {
+		t.Fatal(err)
+	}
+	defer constor.ctl.Close()
+
+	var layers []string
+	if code := ctlrequest(t, socket, "GET", "/layers", "", &layers); code != http.StatusOK {
+		t.Fatalf("GET /layers: %d", code)
+	}
+	if strings.Join(layers, ":") != strings.Join(constor.layers, ":") {
+		t.Errorf("GET /layers: %v, want %v", layers, constor.layers)
+	}
+
+	var level string
+	if code := ctlrequest(t, socket, "PUT", "/loglevel", "debug\n", &level); code != http.StatusOK {
+		t.Fatalf("PUT /loglevel: %d", code)
+	}
+	if level != "debug" || constor.getloglevel() != "debug" {
+		t.Errorf("PUT /loglevel debug: %q, level is %q", level, constor.getloglevel())
+	}
+	if code := ctlrequest(t, socket, "PUT", "/loglevel", "loud", nil); code != http.StatusBadRequest {
+		t.Errorf("PUT /loglevel loud: %d", code)
+	}
+
+	var ops []string
+	if code := ctlrequest(t, socket, "PUT", "/logops", "Lookup:copyup", &ops); code != http.StatusOK {
+		t.Fatalf("PUT /logops: %d", code)
+	}
+	if len(ops) != 2 || len(constor.getlogops()) != 2 {
+		t.Errorf("PUT /logops Lookup:copyup: %v, ops are %v", ops, constor.getlogops())
+	}
+
+	// a lower file copied up and an object of layer0 nothing refers to
+	id := newuuid().String()
+	if err := ioutil.WriteFile(constor.getPath(1, id), []byte("lower"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inode := NewInode(constor, id)
+	inode.setlayer(1)
+	if err := constor.copyup(inode); err != nil {
+		t.Fatal(err)
+	}
+	var copyups map[string]uint64
+	if code := ctlrequest(t, socket, "GET", "/copyups", "", &copyups); code != http.StatusOK {
+		t.Fatalf("GET /copyups: %d", code)
+	}
+	total := uint64(0)
+	for _, count := range copyups {
+		total += count
+	}
+	if total != 1 {
+		t.Errorf("GET /copyups: %v, want one copyup", copyups)
+	}
+
+	if code := ctlrequest(t, socket, "GET", "/sweep", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /sweep: %d", code)
+	}
+	var report sweepreport
+	if code := ctlrequest(t, socket, "PUT", "/sweep", "", &report); code != http.StatusOK {
+		t.Fatalf("PUT /sweep: %d", code)
+	}
+	if len(report.Objects) != 1 || report.Objects[0] != id {
+		t.Errorf("PUT /sweep: objects %v, want %s", report.Objects, id)
+	}
+	if _, err := os.Lstat(Path.Join(constor.layers[0], LOSTDIR, id)); err != nil {
+		t.Errorf("sweep did not quarantine %s : %s", id, err)
+	}
+}
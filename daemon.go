@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+// set in the environment of the background child
+const DAEMONENV = "CONSTOR_DAEMON"
+
+// the child reports readiness on this fd, see daemonize
+const READYFD = 3
+
+// re-executes constor in the background and exits once the child reports
+// that the filesystem is mounted, with the child's status if it fails.
+// Only returns in the child, with the file to report readiness on.
+func daemonize() *os.File {
+	if os.Getenv(DAEMONENV) == "1" {
+		os.Unsetenv(DAEMONENV)
+		return os.NewFile(READYFD, "ready")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "constor: %s\n", err)
+		os.Exit(1)
+	}
+	cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+	// keep argv[0], it tells mount.constor apart from constor
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = append(os.Environ(), DAEMONENV+"=1")
+	cmd.ExtraFiles = []*os.File{w}
+	// errors before the mount is ready still reach the caller
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "constor: %s\n", err)
+		os.Exit(1)
+	}
+	w.Close()
+	buf := make([]byte, 16)
+	n, _ := r.Read(buf)
+	if string(buf[:n]) == "ok" {
+		os.Exit(0)
+	}
+	// the child died before the mount was ready
+	if err := cmd.Wait(); err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() > 0 {
+				os.Exit(status.ExitStatus())
+			}
+		}
+	}
+	os.Exit(1)
+	return nil
+}
+
+// tells the waiting parent that the filesystem is mounted
+func notifyready(ready *os.File) {
+	if ready == nil {
+		return
+	}
+	ready.Write([]byte("ok"))
+	ready.Close()
+}
+
+// sends state to the service manager, see sd_notify(3)
+func sdnotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// a leading '@' for abstract sockets is handled by the net package
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func writepidfile(path string) error {
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// unmounts on SIGTERM and SIGINT after flushing all open files. The open
+// files are only closed once the unmount went through, a busy mount point
+// keeps being served.
+func (constor *Constor) handlesignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range sigs {
+			constor.error("received %s, unmounting", sig)
+			constor.syncfds()
+			if err := constor.ms.Unmount(); err != nil {
+				constor.error("unmount failed : %s", err)
+				continue
+			}
+			constor.closefds()
+			return
+		}
+	}()
+}
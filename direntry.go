@@ -32,6 +32,9 @@ type DirEntry struct {
 	Ino     uint64
 	Offset  uint64
 	Deleted bool
+
+	// Id is the constor ID the entry resolves to
+	Id string
 }
 
 // func (d DirEntry) String() string {
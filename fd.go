@@ -1,10 +1,14 @@
 package main
 
 import (
+		"sync"
+		"syscall"
 		"unsafe"
 )
 
 type FD struct {
+	// guards fd and layer, see inode.go
+	sync.RWMutex
 	fd     int
 	flags  int
 	layer  int
@@ -13,11 +17,24 @@ type FD struct {
 	stream []DirEntry
 }
 
+// open files are also indexed by id and by id and pid, directories are
+// only in fdmap
+type fdkey struct {
+	id  string
+	pid uint32
+}
+
 func (constor *Constor) putfd(F *FD) {
 	constor.Lock()
 	defer constor.Unlock()
 	ptr := uintptr(unsafe.Pointer(F))
 	constor.fdmap[ptr] = F
+	if F.stream != nil {
+		return
+	}
+	key := fdkey{F.id, F.pid}
+	constor.fdids[F.id] = append(constor.fdids[F.id], F)
+	constor.fdpids[key] = append(constor.fdpids[key], F)
 }
 
 func (constor *Constor) getfd(ptr uintptr) *FD {
@@ -30,18 +47,120 @@ func (constor *Constor) getfd(ptr uintptr) *FD {
 func (constor *Constor) deletefd(ptr uintptr) {
 	constor.Lock()
 	defer constor.Unlock()
+	F, ok := constor.fdmap[ptr]
+	if !ok {
+		return
+	}
 	delete(constor.fdmap, ptr)
+	if F.stream != nil {
+		return
+	}
+	key := fdkey{F.id, F.pid}
+	if fds := removefd(constor.fdids[F.id], F); len(fds) > 0 {
+		constor.fdids[F.id] = fds
+	} else {
+		delete(constor.fdids, F.id)
+	}
+	if fds := removefd(constor.fdpids[key], F); len(fds) > 0 {
+		constor.fdpids[key] = fds
+	} else {
+		delete(constor.fdpids, key)
+	}
+}
+
+func removefd(fds []*FD, F *FD) []*FD {
+	for i, f := range fds {
+		if f == F {
+			return append(fds[:i], fds[i+1:]...)
+		}
+	}
+	return fds
 }
 
-// FIXME: need to optimize this
+// an open file of id by the process pid
 func (constor *Constor) fdlookup(id string, pid uint32) *FD {
 	constor.Lock()
 	defer constor.Unlock()
+	fds := constor.fdpids[fdkey{id, pid}]
+	if len(fds) == 0 {
+		return nil
+	}
+	return fds[0]
+}
 
+// the open files of id
+func (constor *Constor) fdsof(id string) []*FD {
+	constor.Lock()
+	defer constor.Unlock()
+	return append([]*FD{}, constor.fdids[id]...)
+}
+
+// reopens F on the layer0 object at path, F is write locked
+func (constor *Constor) reopenfd(F *FD, path string) error {
+	// the file was created or truncated when it was first opened
+	flags := F.flags &^ (syscall.O_CREAT | syscall.O_EXCL | syscall.O_TRUNC)
+	fd, err := syscall.Open(path, flags, 0)
+	if err != nil {
+		constor.error("open failed on %s - %s", path, err)
+		return err
+	}
+	syscall.Close(F.fd)
+	F.fd = fd
+	F.layer = 0
+	constor.log("reset fd for %s", path)
+	return nil
+}
+
+// moves F over to layer0 when its inode is there. copyup moves all files
+// open at the time, this catches those opened while it ran.
+func (constor *Constor) fdswitch(F *FD, inode *Inode) error {
+	F.Lock()
+	defer F.Unlock()
+	if F.layer == 0 || inode.getlayer() != 0 {
+		return nil
+	}
+	return constor.reopenfd(F, constor.getPath(0, inode.id))
+}
+
+// flushes every open file to its layer. The fsyncs run without the
+// constor lock, lookups and getattrs go on meanwhile.
+func (constor *Constor) syncfds() {
+	constor.Lock()
+	fds := make([]*FD, 0, len(constor.fdmap))
 	for _, F := range constor.fdmap {
-		if id == F.id && pid == F.pid {
-			return F
+		if F.stream != nil {
+			// directories have no fd
+			continue
 		}
+		fds = append(fds, F)
 	}
-	return nil
+	constor.Unlock()
+	for _, F := range fds {
+		F.RLock()
+		if F.fd < 0 {
+			// released in the meantime
+			F.RUnlock()
+			continue
+		}
+		if err := syscall.Fsync(F.fd); err != nil {
+			constor.error("fsync failed for %s : %s", F.id, err)
+		}
+		F.RUnlock()
+	}
+}
+
+// closes every open file and forgets about it
+func (constor *Constor) closefds() {
+	constor.Lock()
+	defer constor.Unlock()
+	for ptr, F := range constor.fdmap {
+		if F.stream == nil {
+			F.Lock()
+			syscall.Close(F.fd)
+			F.Unlock()
+		}
+		delete(constor.fdmap, ptr)
+	}
+	constor.fdids = make(map[string][]*FD)
+	constor.fdpids = make(map[fdkey][]*FD)
 }
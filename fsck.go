@@ -0,0 +1,286 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	Path "path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const FSCKUSAGE = `Usage: constor fsck [-r] [-remove] [-o opt[,opt...]] /layer0:/layer1:....:/layerN
+
+Checks a layer stack that is not mounted. It walks the directory tree from
+the root across all layers and reports
+  - entries without an id
+  - entries whose object is in no layer
+  - entries and objects that disagree on being a directory
+  - link counts that differ from the number of entries of an object
+  - objects of layer0 no entry refers to
+The exit status is 1 if problems are left.
+
+Options:
+  -r          repair what is in layer0: link counts are rewritten,
+              entries of missing objects removed, or whited out when
+              a lower layer has the name, and unreferenced objects
+              moved to .constor.lost
+  -remove     with -r, remove unreferenced objects instead
+  -o opts     mount options, only those about layers, whiteouts and
+              logging apply (default log=-)
+`
+
+// Fsck collects the problems of a layer stack
+type Fsck struct {
+	constor *Constor
+	repair  bool
+	mode    string
+	// entries referring to each id
+	refs     map[string]int
+	problems int
+	repaired int
+}
+
+func NewFsck(constor *Constor, repair bool, mode string) *Fsck {
+	fsck := new(Fsck)
+	fsck.constor = constor
+	fsck.repair = repair
+	fsck.mode = mode
+	fsck.refs = make(map[string]int)
+	return fsck
+}
+
+// reports a problem, fix repairs it when repairing and may be nil
+func (fsck *Fsck) report(what string, fix func() error) {
+	fsck.problems++
+	if !fsck.repair || fix == nil {
+		fmt.Println(what)
+		return
+	}
+	if err := fix(); err != nil {
+		fmt.Printf("%s, not repaired : %s\n", what, err)
+		return
+	}
+	fsck.repaired++
+	fmt.Printf("%s, repaired\n", what)
+}
+
+// checks the entries of the merged view of directory id and returns the
+// directories among them
+func (fsck *Fsck) checkdir(id string) []string {
+	constor := fsck.constor
+	dirs := []string{}
+	names := map[string]bool{}
+	for li, _ := range constor.layers {
+		path := constor.getPath(li, id)
+		if constor.isdeleted(path, nil) {
+			break
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			// not copied up to this layer, look in the lower ones
+			continue
+		}
+		entries, _ := f.Readdirnames(0)
+		f.Close()
+		for _, name := range entries {
+			if names[name] {
+				// skip if the file was in upper layer
+				continue
+			}
+			names[name] = true
+			entrypath := Path.Join(path, name)
+			stat := syscall.Stat_t{}
+			if err := syscall.Lstat(entrypath, &stat); err != nil {
+				continue
+			}
+			if constor.isdeleted(entrypath, &stat) {
+				continue
+			}
+			var fix func() error
+			if li == 0 {
+				name := name
+				fix = func() error { return constor.dropentry(id, name) }
+			}
+			eidbytes, err := Lgetxattr(entrypath, IDXATTR)
+			if err != nil || len(eidbytes) == 0 {
+				fsck.report(fmt.Sprintf("entry %s: no id", entrypath), nil)
+				continue
+			}
+			eid := string(eidbytes)
+			eli := constor.getLayer(eid)
+			if eli == -1 {
+				fsck.report(fmt.Sprintf("entry %s: object %s is in no layer", entrypath, eid), fix)
+				continue
+			}
+			fsck.refs[eid]++
+			ostat := syscall.Stat_t{}
+			if err := syscall.Lstat(constor.getPath(eli, eid), &ostat); err != nil {
+				continue
+			}
+			entrydir := (stat.Mode & syscall.S_IFMT) == syscall.S_IFDIR
+			objectdir := (ostat.Mode & syscall.S_IFMT) == syscall.S_IFDIR
+			if entrydir != objectdir {
+				fsck.report(fmt.Sprintf("entry %s: directory mismatch with object %s in layer %d", entrypath, eid, eli), nil)
+				continue
+			}
+			if objectdir && fsck.refs[eid] == 1 {
+				dirs = append(dirs, eid)
+			}
+		}
+	}
+	return dirs
+}
+
+// compares the recorded link count of each referenced object with the
+// entries found, only objects of layer0 are repaired. Lower layer objects
+// may have fewer entries in view than they record.
+func (fsck *Fsck) checklinks() {
+	constor := fsck.constor
+	for id, n := range fsck.refs {
+		li := constor.getLayer(id)
+		path := constor.getPath(li, id)
+		stat := syscall.Stat_t{}
+		if err := syscall.Lstat(path, &stat); err != nil {
+			continue
+		}
+		if (stat.Mode & syscall.S_IFMT) == syscall.S_IFDIR {
+			if n > 1 {
+				fsck.report(fmt.Sprintf("object %s: directory with %d entries", path, n), nil)
+			}
+			continue
+		}
+		links := 1
+		if linksbyte, err := Lgetxattr(path, LINKSXATTR); err == nil && len(linksbyte) != 0 {
+			links, err = strconv.Atoi(string(linksbyte))
+			if err != nil {
+				links = -1
+			}
+		}
+		if links == n {
+			continue
+		}
+		if li != 0 && links > n {
+			// the other links were deleted or hidden above the layer
+			continue
+		}
+		var fix func() error
+		if li == 0 {
+			fix = func() error {
+				if n == 1 {
+					return Lremovexattr(path, LINKSXATTR)
+				}
+				return Lsetxattr(path, LINKSXATTR, []byte(strconv.Itoa(n)), 0)
+			}
+		}
+		fsck.report(fmt.Sprintf("object %s: %d links recorded, %d entries", path, links, n), fix)
+	}
+}
+
+// reports the objects of layer0 no entry refers to. Lower layers keep the
+// objects of entries deleted above them, those are no problem.
+func (fsck *Fsck) checkobjects() {
+	constor := fsck.constor
+	layer := constor.layers[0]
+	f, err := os.Open(layer)
+	if err != nil {
+		fsck.report(fmt.Sprintf("layer %s: %s", layer, err), nil)
+		return
+	}
+	names, _ := f.Readdirnames(0)
+	f.Close()
+	for _, id := range names {
+		if id == ROOTID || id == ORPHANDIR || id == LOSTDIR || strings.HasPrefix(id, TMPPREFIX) {
+			continue
+		}
+		if fsck.refs[id] != 0 {
+			continue
+		}
+		path := constor.getPath(0, id)
+		if constor.isdeleted(path, nil) {
+			continue
+		}
+		id := id
+		fix := func() error { return constor.loseobject(id, fsck.mode) }
+		fsck.report(fmt.Sprintf("object %s: no entry refers to it", path), fix)
+	}
+}
+
+func (fsck *Fsck) run() {
+	constor := fsck.constor
+	if constor.getLayer(ROOTID) == -1 {
+		fsck.report(fmt.Sprintf("root %s is in no layer", ROOTID), nil)
+		return
+	}
+	fsck.refs[ROOTID] = 1
+	queue := []string{ROOTID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		queue = append(queue, fsck.checkdir(id)...)
+	}
+	fsck.checklinks()
+	fsck.checkobjects()
+}
+
+func fsckmain(args []string) int {
+	opts := defaultoptions()
+	opts.logfile = "-"
+	var o optlist
+	flags := flag.NewFlagSet("constor fsck", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.Var(&o, "o", "")
+	repair := flags.Bool("r", false, "")
+	remove := flags.Bool("remove", false, "")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Print(FSCKUSAGE)
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "constor fsck: %s\n\n%s", err, FSCKUSAGE)
+		return 1
+	}
+	for _, opt := range o {
+		for _, opt := range strings.Split(opt, ",") {
+			if opt == "" {
+				continue
+			}
+			if err := opts.set(opt); err != nil {
+				fmt.Fprintf(os.Stderr, "constor fsck: %s\n", err)
+				return 1
+			}
+		}
+	}
+	args = flags.Args()
+	if len(opts.layers) == 0 && len(args) == 1 {
+		opts.layers = splitlist(args[0])
+		args = args[1:]
+	}
+	if len(args) != 0 {
+		fmt.Fprint(os.Stderr, FSCKUSAGE)
+		return 1
+	}
+	if err := opts.validatelayers(); err != nil {
+		fmt.Fprintf(os.Stderr, "constor fsck: %s\n", err)
+		return 1
+	}
+	logf, err := openlog(opts.logfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "constor fsck: unable to open log %s : %s\n", opts.logfile, err)
+		return 1
+	}
+	mode := SWEEP_QUARANTINE
+	if *remove {
+		mode = SWEEP_REMOVE
+	}
+
+	fsck := NewFsck(NewConstor(opts, logf), *repair, mode)
+	fsck.run()
+	fmt.Printf("%d problems, %d repaired\n", fsck.problems, fsck.repaired)
+	if fsck.problems > fsck.repaired {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	Path "path"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// fsck -r rewrites a wrong link count and quarantines an object no entry
+// refers to, a second run finds nothing
+func TestFsckRepair(t *testing.T) {
+	needroot(t)
+	constor := newtestconstor(t, WHITEOUT_LEGACY)
+	defer removetestconstor(constor)
+
+	root := fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+	var f fuse.CreateOut
+	if code := constor.Create(&fuse.CreateIn{InHeader: root, Flags: uint32(os.O_RDWR), Mode: 0644}, "f", &f); !code.Ok() {
+		t.Fatal(code)
+	}
+	constor.Release(&fuse.ReleaseIn{Fh: f.Fh})
+	fid := constor.inodemap.findInodePtr(f.NodeId).id
+	if err := Lsetxattr(constor.getPath(0, fid), LINKSXATTR, []byte("3"), 0); err != nil {
+		t.Fatal(err)
+	}
+	lost := newuuid().String()
+	if err := ioutil.WriteFile(constor.getPath(0, lost), []byte("lost"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fsck := NewFsck(constor, true, SWEEP_QUARANTINE)
+	fsck.run()
+	if fsck.problems != 2 || fsck.repaired != 2 {
+		t.Errorf("%d problems, %d repaired, want 2 and 2", fsck.problems, fsck.repaired)
+	}
+	if links, err := Lgetxattr(constor.getPath(0, fid), LINKSXATTR); err == nil && len(links) != 0 {
+		t.Errorf("%s still records %s links", fid, links)
+	}
+	if _, err := os.Lstat(constor.getPath(0, lost)); !os.IsNotExist(err) {
+		t.Errorf("unreferenced %s is still in layer0 : %v", lost, err)
+	}
+	if data, err := ioutil.ReadFile(Path.Join(constor.layers[0], LOSTDIR, lost)); string(data) != "lost" {
+		t.Errorf("unreferenced %s was not quarantined : %q %v", lost, data, err)
+	}
+
+	fsck = NewFsck(constor, false, SWEEP_QUARANTINE)
+	fsck.run()
+	if fsck.problems != 0 {
+		t.Errorf("%d problems left after the repair", fsck.problems)
+	}
+}
@@ -1,32 +1,16 @@
 package main
 
 import (
-	"fmt"
-	"io"
+	"io/ioutil"
 	"os"
 	Path "path"
-	"runtime"
 	"syscall"
 	"unsafe"
 	"strconv"
+	"strings"
 )
 
 
-func (constor *Constor) log(format string, a ...interface{}) {
-	return
-	pc, file, line, _ := runtime.Caller(1)
-	info := fmt.Sprintf(format, a...)
-	funcName := runtime.FuncForPC(pc).Name()
-	fmt.Fprintf(constor.logf, "%s:%d:%s %v\n", Path.Base(file), line, funcName, info)
-}
-
-func (constor *Constor) error(format string, a ...interface{}) {
-	pc, file, line, _ := runtime.Caller(1)
-	info := fmt.Sprintf(format, a...)
-	funcName := runtime.FuncForPC(pc).Name()
-	fmt.Fprintf(constor.logf, "ERR %s:%d:%s %v\n", Path.Base(file), line, funcName, info)
-}
-
 func Lgetxattr(path string, attr string) ([]byte, error) {
 	pathBytes, err := syscall.BytePtrFromString(path)
 	if err != nil {
@@ -43,7 +27,12 @@ func Lgetxattr(path string, attr string) ([]byte, error) {
 		return nil, nil
 	}
 	if errno == syscall.ERANGE {
-		dest = make([]byte, sz)
+		// ask the kernel for the size, the returned sz is not valid on ERANGE
+		sz, _, errno = syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(pathBytes)), uintptr(unsafe.Pointer(attrBytes)), 0, 0, 0, 0)
+		if errno != 0 {
+			return nil, errno
+		}
+		dest = make([]byte, sz+1)
 		destBytes := unsafe.Pointer(&dest[0])
 		sz, _, errno = syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(pathBytes)), uintptr(unsafe.Pointer(attrBytes)), uintptr(destBytes), uintptr(len(dest)), 0, 0)
 	}
@@ -54,6 +43,108 @@ func Lgetxattr(path string, attr string) ([]byte, error) {
 	return dest[:sz], nil
 }
 
+func Llistxattr(path string) ([]string, error) {
+	pathBytes, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	sz, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(pathBytes)), 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	if sz == 0 {
+		return []string{}, nil
+	}
+	dest := make([]byte, sz)
+	destBytes := unsafe.Pointer(&dest[0])
+	sz, _, errno = syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(pathBytes)), uintptr(destBytes), uintptr(len(dest)))
+	if errno != 0 {
+		return nil, errno
+	}
+	attrs := []string{}
+	for _, attr := range strings.Split(string(dest[:sz]), "\x00") {
+		if attr != "" {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs, nil
+}
+
+func Lremovexattr(path string, attr string) error {
+	pathBytes, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attrBytes, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_LREMOVEXATTR, uintptr(unsafe.Pointer(pathBytes)), uintptr(unsafe.Pointer(attrBytes)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// trusted.constor.* keys carry the layer metadata and are never exposed
+func isinternalxattr(attr string) bool {
+	return strings.HasPrefix(attr, "trusted.constor.")
+}
+
+// reports whether attr passes the copyup namespace filter. Entries of
+// xattrdeny and xattrallow are prefixes such as "security." or "user.",
+// an empty xattrallow allows everything that is not denied.
+func (constor *Constor) xattrallowed(attr string) bool {
+	for _, prefix := range constor.xattrdeny {
+		if strings.HasPrefix(attr, prefix) {
+			return false
+		}
+	}
+	if len(constor.xattrallow) == 0 {
+		return true
+	}
+	for _, prefix := range constor.xattrallow {
+		if strings.HasPrefix(attr, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// copies the xattrs of src that pass the filter to dst, this includes
+// ACLs, file capabilities and security labels
+func (constor *Constor) copyxattrs(src string, dst string) error {
+	attrs, err := Llistxattr(src)
+	if err == syscall.EOPNOTSUPP {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		if isinternalxattr(attr) || !constor.xattrallowed(attr) {
+			continue
+		}
+		data, err := Lgetxattr(src, attr)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			// removed in the meantime
+			continue
+		}
+		err = Lsetxattr(dst, attr, data, 0)
+		if err == syscall.EOPNOTSUPP {
+			constor.error("%s not supported on layer0, dropping it for %s", attr, src)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var _zero uintptr
 
 func Lsetxattr(path string, attr string, data []byte, flags int) error {
@@ -124,6 +215,63 @@ func (constor *Constor) declinkscnt(id string) (int, error) {
 	return count, err
 }
 
+// drops a link to a non directory object and moves it out of layer0 with
+// the last one. The single link of a lower layer object only marks it
+// unlinked, one of several links copies it up to count them in layer0 like
+// Link does. The entry itself is left to the caller.
+func (constor *Constor) unlinkobject(inode *Inode) error {
+	if li := inode.getlayer(); li > 0 {
+		links, err := Lgetxattr(constor.getPath(li, inode.id), LINKSXATTR)
+		if err == nil && len(links) != 0 {
+			if n, err := strconv.Atoi(string(links)); err == nil && n > 1 {
+				if err := constor.copyup(inode); err != nil {
+					constor.error("copyup failed on %s : %s", inode.id, err)
+					return err
+				}
+			}
+		}
+	}
+	inode.layermu.Lock()
+	defer inode.layermu.Unlock()
+	li := inode.getlayer()
+	if li > 0 {
+		inode.setlayer(-1)
+		return nil
+	}
+	if li != 0 {
+		return nil
+	}
+	linkcnt, err := constor.declinkscnt(inode.id)
+	if err != nil {
+		constor.error("declinkscnt %s : %s", inode.id, err)
+		return err
+	}
+	if linkcnt == 0 {
+		// reclaimed once the inode is forgotten and no file is open on it
+		if err := constor.orphanobject(inode.id); err != nil {
+			constor.error("orphanobject failed for %s : %s", inode.id, err)
+			return err
+		}
+		inode.setlayer(-1)
+	}
+	return nil
+}
+
+// removes an empty directory object from layer0
+func (constor *Constor) rmdirobject(inode *Inode) error {
+	inode.layermu.Lock()
+	defer inode.layermu.Unlock()
+	if inode.getlayer() == 0 {
+		path := constor.getPath(0, inode.id)
+		if err := os.RemoveAll(path); err != nil {
+			constor.error("RemoveAll on %s : %s", path, err)
+			return err
+		}
+	}
+	inode.setlayer(-1)
+	return nil
+}
+
 func (constor *Constor) setdeleted(path string) error {
 	err := syscall.Mknod(path, syscall.S_IFCHR, 0)
 	if err != nil {
@@ -131,9 +279,13 @@ func (constor *Constor) setdeleted(path string) error {
 		if err != nil {
 			constor.error("unable to rm %s %s", path, err)
 		}
-		return syscall.Mknod(path, syscall.S_IFCHR, 0)
+		err = syscall.Mknod(path, syscall.S_IFCHR, 0)
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+	// tag it so a whiteout can be told apart from a real 0:0 device
+	return Lsetxattr(path, DELXATTR, []byte("1"), 0)
 }
 
 func (constor *Constor) isdeleted(path string, stat *syscall.Stat_t) bool {
@@ -145,11 +297,98 @@ func (constor *Constor) isdeleted(path string, stat *syscall.Stat_t) bool {
 		}
 		stat = &stattmp
 	}
-	if ((stat.Mode & syscall.S_IFMT) == syscall.S_IFCHR) && stat.Rdev == 0 {
+	if ((stat.Mode & syscall.S_IFMT) != syscall.S_IFCHR) || stat.Rdev != 0 {
+		return false
+	}
+	if constor.whiteout != WHITEOUT_STRICT {
 		return true
-	} else {
+	}
+	deleted, err := Lgetxattr(path, DELXATTR)
+	return err == nil && len(deleted) != 0
+}
+
+// tags the untagged whiteouts of layer li with DELXATTR so that they are
+// still recognized in strict mode, see constor migrate. Returns the number
+// of tagged whiteouts.
+func (constor *Constor) migratewhiteouts(li int) (int, error) {
+	count := 0
+	root := constor.layers[li]
+	f, err := os.Open(root)
+	if err != nil {
+		return count, err
+	}
+	names, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		return count, err
+	}
+	for _, name := range names {
+		if name == ORPHANDIR || name == LOSTDIR || strings.HasPrefix(name, TMPPREFIX) {
+			// objects, not entries
+			continue
+		}
+		dirpath := Path.Join(root, name)
+		stat := syscall.Stat_t{}
+		if err := syscall.Lstat(dirpath, &stat); err != nil {
+			continue
+		}
+		if (stat.Mode & syscall.S_IFMT) != syscall.S_IFDIR {
+			continue
+		}
+		d, err := os.Open(dirpath)
+		if err != nil {
+			return count, err
+		}
+		infos, _ := d.Readdir(0)
+		d.Close()
+		for i := range infos {
+			// workaround forhttps://code.google.com/p/go/issues/detail?id=5960
+			if infos[i] == nil {
+				continue
+			}
+			stat := infos[i].Sys().(*syscall.Stat_t)
+			if ((stat.Mode & syscall.S_IFMT) != syscall.S_IFCHR) || stat.Rdev != 0 {
+				continue
+			}
+			path := Path.Join(dirpath, infos[i].Name())
+			if deleted, err := Lgetxattr(path, DELXATTR); err == nil && len(deleted) != 0 {
+				continue
+			}
+			if id, err := Lgetxattr(path, IDXATTR); err == nil && len(id) != 0 {
+				// the entry of a real 0:0 device made by Mknod
+				continue
+			}
+			if err := Lsetxattr(path, DELXATTR, []byte("1"), 0); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// checks the caller's primary and supplementary groups against gid
+func (constor *Constor) ingroup(pid uint32, callergid uint32, gid uint32) bool {
+	if callergid == gid {
+		return true
+	}
+	status, err := ioutil.ReadFile("/proc/" + strconv.Itoa(int(pid)) + "/status")
+	if err != nil {
+		constor.error("unable to read groups of %d : %s", pid, err)
 		return false
 	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, g := range strings.Fields(line[len("Groups:"):]) {
+			if g == strconv.Itoa(int(gid)) {
+				return true
+			}
+		}
+		break
+	}
+	return false
 }
 
 func (constor *Constor) getLayer(id string) int {
@@ -159,12 +398,110 @@ func (constor *Constor) getLayer(id string) int {
 			return -1
 		}
 		if _, err := os.Lstat(path); err == nil {
+			constor.metrics.layerhit(i)
 			return i
 		}
 	}
 	return -1
 }
 
+// returns the S_IFMT bits of the object id resolves to
+func (constor *Constor) idtype(id string) (uint32, error) {
+	li := -1
+	if inode := constor.inodemap.findInodeId(id); inode != nil {
+		li = inode.getlayer()
+	} else {
+		li = constor.getLayer(id)
+	}
+	if li == -1 {
+		return 0, syscall.ENOENT
+	}
+	stat := syscall.Stat_t{}
+	if err := syscall.Lstat(constor.getPath(li, id), &stat); err != nil {
+		return 0, err
+	}
+	return stat.Mode & syscall.S_IFMT, nil
+}
+
+// reports whether the merged view of directory id has no entries
+func (constor *Constor) dirempty(id string) bool {
+	entries := map[string]bool{}
+	for li, _ := range constor.layers {
+		path := constor.getPath(li, id)
+		stat := syscall.Stat_t{}
+		err := syscall.Lstat(path, &stat)
+		if err != nil {
+			// not copied up to this layer, look in the lower ones
+			continue
+		}
+		if (stat.Mode & syscall.S_IFMT) != syscall.S_IFDIR {
+			constor.error("Not a dir: %s", path)
+			break
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			constor.error("Open failed on %s", path)
+			break
+		}
+		infos, _ := f.Readdir(0)
+		f.Close()
+		for i := range infos {
+			// workaround forhttps://code.google.com/p/go/issues/detail?id=5960
+			if infos[i] == nil {
+				continue
+			}
+			name := infos[i].Name()
+			if _, ok := entries[name]; ok {
+				// skip if the file was in upper layer
+				continue
+			}
+			deleted := constor.isdeleted(Path.Join(path, name), infos[i].Sys().(*syscall.Stat_t))
+			if !deleted {
+				return false
+			}
+			entries[name] = deleted
+		}
+	}
+	return true
+}
+
+// replaces whatever is at path with a placeholder entry of type mode
+// pointing to the object id
+func (constor *Constor) mkplaceholder(path string, id string, mode uint32) error {
+	stat := syscall.Stat_t{}
+	if err := syscall.Lstat(path, &stat); err == nil {
+		if (stat.Mode & syscall.S_IFMT) == syscall.S_IFDIR {
+			err = syscall.Rmdir(path)
+		} else {
+			err = syscall.Unlink(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFLNK:
+		if err := syscall.Symlink("placeholder", path); err != nil {
+			return err
+		}
+	case syscall.S_IFDIR:
+		if err := syscall.Mkdir(path, mode&07777); err != nil {
+			return err
+		}
+	default:
+		fd, err := syscall.Creat(path, mode&07777)
+		if err != nil {
+			return err
+		}
+		syscall.Close(fd)
+	}
+	if constor.setid(path, id) == "" {
+		return syscall.EIO
+	}
+	return nil
+}
+
 // Use this function in case we have too many dirs/files in the layer's root
 // func (constor *Constor) getPath(li int, id string) string {
 // 	return Path.Join(constor.layers[li], id[:2], id[2:4], id)
@@ -209,6 +546,7 @@ func (constor *Constor) getid(li int, id string, name string) (string, error) {
 		if err != nil || len(inobyte) == 0 {
 			return "", syscall.ENOENT
 		}
+		constor.metrics.layerhit(li)
 		return string(inobyte), nil
 	}
 	for li, _ := range constor.layers {
@@ -222,6 +560,7 @@ func (constor *Constor) getid(li int, id string, name string) (string, error) {
 			if len(inobyte) == 0 {
 				return "", syscall.ENOENT
 			}
+			constor.metrics.layerhit(li)
 			return string(inobyte), nil
 		}
 	}
@@ -247,49 +586,222 @@ func (constor *Constor) createPath(id string) error {
 	// return os.MkdirAll(path, 0770)
 }
 
+// copyup objects are staged under this prefix in the root of layer0 and
+// renamed into place once complete, so a partial copy is never visible
+const TMPPREFIX = ".constor.tmp."
+
+func (constor *Constor) tmpPath() string {
+	return Path.Join(constor.layers[0], TMPPREFIX+newuuid().String())
+}
+
+// removes staged copyups and orphans left behind by a crash
+func (constor *Constor) cleantmp() error {
+	f, err := os.Open(constor.layers[0])
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		// nothing is open on the orphans any more
+		if !strings.HasPrefix(name, TMPPREFIX) && name != ORPHANDIR {
+			continue
+		}
+		path := Path.Join(constor.layers[0], name)
+		if err := os.RemoveAll(path); err != nil {
+			constor.error("unable to remove %s : %s", path, err)
+		}
+	}
+	return nil
+}
+
+// reports whether layer li and layer0 are on the same filesystem
+func (constor *Constor) samefs(li int) bool {
+	var stat0, stat syscall.Stat_t
+	if err := syscall.Stat(constor.layers[0], &stat0); err != nil {
+		return false
+	}
+	if err := syscall.Stat(constor.layers[li], &stat); err != nil {
+		return false
+	}
+	return stat0.Dev == stat.Dev
+}
+
+func syncdir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// a copyup in flight, see copyup
+type copyupcall struct {
+	done chan struct{}
+	err  error
+}
+
+// copies inode up to layer0. Only the first caller copies, callers that
+// come in while it runs wait for it and share its result. Logs as
+// "copyup", see logops.
 func (constor *Constor) copyup(inode *Inode) error {
 	constor.log("%s", inode.id)
-	if inode.layer == 0 {
+	err := constor.copyupwith(inode, true)
+	constor.log("done %s : %v", inode.id, err)
+	return err
+}
+
+// copies up a regular file without its data, for opens that truncate it
+func (constor *Constor) copyupempty(inode *Inode) error {
+	constor.log("%s", inode.id)
+	err := constor.copyupwith(inode, false)
+	constor.log("done %s : %v", inode.id, err)
+	return err
+}
+
+// runs one copyup of inode at a time, the others wait for it and share
+// its result
+func (constor *Constor) copyupwith(inode *Inode, data bool) error {
+	if inode.getlayer() == 0 {
 		return nil
 	}
-	src := constor.getPath(inode.layer, inode.id)
-	if src == "" {
-		return syscall.EIO
+	constor.Lock()
+	if call, ok := constor.copyupcalls[inode.id]; ok {
+		constor.Unlock()
+		constor.log("waiting for the copyup of %s", inode.id)
+		<-call.done
+		return call.err
+	}
+	call := &copyupcall{done: make(chan struct{})}
+	constor.copyupcalls[inode.id] = call
+	constor.Unlock()
+
+	call.err = constor.docopyup(inode, data)
+
+	constor.Lock()
+	delete(constor.copyupcalls, inode.id)
+	constor.Unlock()
+	close(call.done)
+	return call.err
+}
+
+func (constor *Constor) docopyup(inode *Inode, data bool) (err error) {
+	inode.layermu.Lock()
+	defer inode.layermu.Unlock()
+	li := inode.getlayer()
+	if li == 0 {
+		return nil
+	}
+	if li == -1 {
+		return syscall.ENOENT
+	}
+	if constor.readonly {
+		return syscall.EROFS
 	}
 	dst := constor.getPath(0, inode.id)
 	if dst == "" {
 		return syscall.EIO
 	}
+	if err := constor.copyobject(li, inode.id, dst, data); err != nil {
+		return err
+	}
+	if err := syncdir(constor.layers[0]); err != nil {
+		constor.error("sync of %s failed : %s", constor.layers[0], err)
+	}
+	// the inode and all files open on it move to layer0 at once
+	fds := constor.fdsof(inode.id)
+	for _, F := range fds {
+		F.Lock()
+	}
+	inode.setlayer(0)
+	for _, F := range fds {
+		if F.layer != 0 {
+			// left to fdswitch on the next read or write
+			constor.reopenfd(F, dst)
+		}
+		F.Unlock()
+	}
+	return nil
+}
+
+// copies the object id of layer li to dst in layer0, it is staged under
+// TMPPREFIX and only shows up at dst once complete
+func (constor *Constor) copyobject(li int, id string, dst string, data bool) (err error) {
+	src := constor.getPath(li, id)
+	if src == "" {
+		return syscall.EIO
+	}
 	fi, err := os.Lstat(src)
 	if err != nil {
 		return err
 	}
+	stat := syscall.Stat_t{}
+	if err = syscall.Lstat(src, &stat); err != nil {
+		return err
+	}
+	// a whiteout is never a valid object to copy up
+	if constor.isdeleted(src, &stat) {
+		constor.error("%s is a whiteout", src)
+		return syscall.ENOENT
+	}
+	tmp := constor.tmpPath()
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
 	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
 		linkName, err := os.Readlink(src)
 		if err != nil {
 			return err
 		}
-		err = os.Symlink(linkName, dst)
+		err = os.Symlink(linkName, tmp)
 		if err != nil {
 			return err
 		}
+		constor.metrics.copyup("symlink", 0)
 	} else if fi.Mode()&os.ModeDir == os.ModeDir {
-		err := os.Mkdir(dst, fi.Mode())
+		err := os.Mkdir(tmp, fi.Mode())
 		if err != nil {
 			return err
 		}
+		constor.metrics.copyup("dir", 0)
+	} else if fi.Mode()&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
+		// never open these, it blocks on FIFOs and reads from devices
+		err := syscall.Mknod(tmp, stat.Mode, int(stat.Rdev))
+		if err != nil {
+			return err
+		}
+		constor.metrics.copyup("special", 0)
+	} else if !data {
+		out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		out.Close()
+		constor.metrics.copyup("truncate", 0)
 	} else {
 		in, err := os.Open(src)
 		if err != nil {
 			return err
 		}
 		defer in.Close()
-		out, err := os.Create(dst)
+		out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 		if err != nil {
 			return err
 		}
 		defer out.Close()
-		_, err = io.Copy(out, in)
+		strategy, copied, err := copydata(out, in, constor.samefs(li))
+		if err != nil {
+			return err
+		}
+		constor.metrics.copyup(strategy, copied)
+		constor.log("%s copied with %s", id, strategy)
+		err = out.Sync()
 		if err != nil {
 			return err
 		}
@@ -298,32 +810,89 @@ func (constor *Constor) copyup(inode *Inode) error {
 			return err
 		}
 	}
-	stat := syscall.Stat_t{}
-	if err = syscall.Lstat(src, &stat); err != nil {
+	// chown drops setuid bits and file capabilities, it goes first
+	if err = syscall.Lchown(tmp, int(stat.Uid), int(stat.Gid)); err != nil {
 		return err
 	}
 	if fi.Mode()&os.ModeSymlink != os.ModeSymlink {
-		if err = syscall.Chmod(dst, stat.Mode); err != nil {
+		if err = syscall.Chmod(tmp, stat.Mode&07777); err != nil {
 			return err
 		}
 	}
-	if err = syscall.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
-		return err
-	}
 	links, err := Lgetxattr(src, LINKSXATTR)
 	if err == nil && len(links) > 0 {
-		err := Lsetxattr(dst, LINKSXATTR, links, 0)
+		err := Lsetxattr(tmp, LINKSXATTR, links, 0)
 		if err != nil {
 			return err
 		}
 	}
+	if err = constor.copyxattrs(src, tmp); err != nil {
+		return err
+	}
 
 	if fi.Mode()&os.ModeSymlink != os.ModeSymlink {
-		if err = syscall.UtimesNano(dst, []syscall.Timespec{stat.Atim, stat.Mtim}); err != nil {
+		if err = syscall.UtimesNano(tmp, []syscall.Timespec{stat.Atim, stat.Mtim}); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, dst)
+}
+
+// an object that lost its last entry while still open in a lower layer is
+// copied up here by id once it has to change, see orphanup
+const ORPHANDIR = ".constor.orphans"
+
+func (constor *Constor) orphanPath(id string) string {
+	return Path.Join(constor.layers[0], ORPHANDIR, id)
+}
+
+// copies the unlinked lower layer object of inode into the orphan area and
+// moves the files open on it there
+func (constor *Constor) orphanup(inode *Inode) error {
+	inode.layermu.Lock()
+	defer inode.layermu.Unlock()
+	if inode.getlayer() != -1 {
+		return nil
+	}
+	if constor.readonly {
+		return syscall.EROFS
+	}
+	fds := constor.fdsof(inode.id)
+	li := 0
+	for _, F := range fds {
+		F.RLock()
+		if F.layer != 0 {
+			li = F.layer
+		}
+		F.RUnlock()
+	}
+	if li == 0 {
+		// all of them are there already
+		return nil
+	}
+	dst := constor.orphanPath(inode.id)
+	if _, err := os.Lstat(dst); os.IsNotExist(err) {
+		err := os.Mkdir(Path.Dir(dst), 0700)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+		// lower layers never change, the copy needs no fd locked
+		if err := constor.copyobject(li, inode.id, dst, true); err != nil {
 			return err
 		}
+	} else if err != nil {
+		return err
+	}
+	for _, F := range fds {
+		F.Lock()
+		if F.layer != 0 {
+			if err := constor.reopenfd(F, dst); err != nil {
+				F.Unlock()
+				return err
+			}
+		}
+		F.Unlock()
 	}
-	inode.layer = 0
-	constor.log("done", inode.id)
+	constor.log("orphaned %s", inode.id)
 	return nil
 }
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	Path "path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const IMPORTUSAGE = `Usage: constor import [-o opt[,opt...]] SRCDIR LAYERDIR
+
+Converts the ordinary directory tree SRCDIR into a constor layer in
+LAYERDIR, which must be empty or not exist. Ownership, modes, times,
+xattrs, symlinks and special files are kept, hard links share one object.
+
+IDs are derived from the path below SRCDIR, importing the same tree twice
+gives the same layer. Trees imported as layers of one stack share the IDs
+of the paths they have in common, so they merge by path. Hard linked files
+are the exception, their ID is derived from all their paths together and
+only matches a file with exactly the same links.
+
+A 0:0 char device is a whiteout to a stack mounted with whiteout=legacy.
+Trees holding one are refused unless imported with -o whiteout=strict,
+the layer must then always be mounted with whiteout=strict.
+
+Options:
+  -o opts     mount options, only those about whiteouts, xattrs and
+              logging apply (default log=-)
+`
+
+// Importer converts a directory tree into layer0 of its constor
+type Importer struct {
+	constor *Constor
+	src     string
+	samefs  bool
+	// ids of the directories imported so far by path below src
+	dirs map[string]string
+	// paths of hard linked files by device and inode, found before the
+	// import
+	groups map[[2]uint64][]string
+	// ids of hard linked files by device and inode, and their links
+	inodes map[[2]uint64]string
+	links  map[string]int
+	// directory objects get their times once all entries are in
+	dirtimes []string
+	stats    map[string]*syscall.Stat_t
+}
+
+func NewImporter(constor *Constor, src string) *Importer {
+	importer := new(Importer)
+	importer.constor = constor
+	importer.src = src
+	importer.dirs = make(map[string]string)
+	importer.groups = make(map[[2]uint64][]string)
+	importer.inodes = make(map[[2]uint64]string)
+	importer.links = make(map[string]int)
+	importer.stats = make(map[string]*syscall.Stat_t)
+	return importer
+}
+
+// the id of the file at rel below src
+func importid(rel string) string {
+	if rel == "." {
+		return ROOTID
+	}
+	return nameuuid(rel).String()
+}
+
+// the id of a file hard linked at the paths rels below src. A plain path
+// id would let the other links resolve to an unrelated file of another
+// layer at the first path.
+func importlinkid(rels []string) string {
+	if len(rels) == 1 {
+		// the other links are outside of the tree
+		return importid(rels[0])
+	}
+	return groupuuid(rels).String()
+}
+
+const (
+	AT_FDCWD            = -0x64
+	AT_SYMLINK_NOFOLLOW = 0x100
+)
+
+// sets the times of path without following a symlink
+func Lutimes(path string, ts []syscall.Timespec) error {
+	pathBytes, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	atfdcwd := AT_FDCWD
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(atfdcwd), uintptr(unsafe.Pointer(pathBytes)), uintptr(unsafe.Pointer(&ts[0])), AT_SYMLINK_NOFOLLOW, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// creates the object dst as a copy of src, the times of directories are
+// left to finish
+func (importer *Importer) object(src string, dst string, stat *syscall.Stat_t) error {
+	constor := importer.constor
+	switch stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		if err := os.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+	case syscall.S_IFLNK:
+		linkName, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(linkName, dst); err != nil {
+			return err
+		}
+	case syscall.S_IFREG:
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		strategy, _, err := copydata(out, in, importer.samefs)
+		if err != nil {
+			return err
+		}
+		constor.trace("%s copied with %s", src, strategy)
+		if err := out.Close(); err != nil {
+			return err
+		}
+	default:
+		if (stat.Mode&syscall.S_IFMT) == syscall.S_IFCHR && stat.Rdev == 0 && constor.whiteout != WHITEOUT_STRICT {
+			return fmt.Errorf("0:0 char device would be a whiteout, import with -o whiteout=strict")
+		}
+		// never open these, it blocks on FIFOs and reads from devices
+		if err := syscall.Mknod(dst, stat.Mode, int(stat.Rdev)); err != nil {
+			return err
+		}
+	}
+	// chown drops setuid bits and file capabilities, it goes first
+	if err := syscall.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+		return err
+	}
+	if (stat.Mode & syscall.S_IFMT) != syscall.S_IFLNK {
+		if err := syscall.Chmod(dst, stat.Mode&07777); err != nil {
+			return err
+		}
+	}
+	if err := constor.copyxattrs(src, dst); err != nil {
+		return err
+	}
+	if (stat.Mode & syscall.S_IFMT) == syscall.S_IFDIR {
+		return nil
+	}
+	return Lutimes(dst, []syscall.Timespec{stat.Atim, stat.Mtim})
+}
+
+// imports the file at path, called by filepath.Walk in lexical order so
+// that the parent directory is always there
+func (importer *Importer) walk(path string, fi os.FileInfo, err error) error {
+	constor := importer.constor
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(importer.src, path)
+	if err != nil {
+		return err
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("%s: no stat", path)
+	}
+	id := importid(rel)
+	if fi.IsDir() {
+		importer.dirs[rel] = id
+		importer.dirtimes = append(importer.dirtimes, id)
+		importer.stats[id] = stat
+	} else if stat.Nlink > 1 {
+		key := [2]uint64{stat.Dev, stat.Ino}
+		if hid, ok := importer.inodes[key]; ok {
+			// the object is there already, only the entry is missing
+			id = hid
+			importer.links[id]++
+			return importer.entry(rel, id, stat.Mode)
+		}
+		rels, ok := importer.groups[key]
+		if !ok {
+			// linked since the tree was scanned
+			rels = []string{rel}
+		}
+		id = importlinkid(rels)
+		importer.inodes[key] = id
+		importer.links[id] = 1
+	}
+	constor.log("%s : %s", rel, id)
+	if err := importer.object(path, constor.getPath(0, id), stat); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if rel == "." {
+		return nil
+	}
+	return importer.entry(rel, id, stat.Mode)
+}
+
+// collects the paths of the hard linked files, in lexical order
+func (importer *Importer) scan(path string, fi os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || fi.IsDir() || stat.Nlink <= 1 {
+		return nil
+	}
+	rel, err := filepath.Rel(importer.src, path)
+	if err != nil {
+		return err
+	}
+	key := [2]uint64{stat.Dev, stat.Ino}
+	importer.groups[key] = append(importer.groups[key], rel)
+	return nil
+}
+
+// creates the entry of rel in its parent directory
+func (importer *Importer) entry(rel string, id string, mode uint32) error {
+	parent, ok := importer.dirs[filepath.Dir(rel)]
+	if !ok {
+		return fmt.Errorf("%s: parent directory not imported", rel)
+	}
+	entrypath := Path.Join(importer.constor.getPath(0, parent), filepath.Base(rel))
+	if err := importer.constor.mkplaceholder(entrypath, id, mode); err != nil {
+		return fmt.Errorf("%s: %s", entrypath, err)
+	}
+	return nil
+}
+
+// records the link counts and the times of the directories
+func (importer *Importer) finish() error {
+	constor := importer.constor
+	for id, links := range importer.links {
+		if links == 1 {
+			// the hard links were outside of the tree
+			continue
+		}
+		path := constor.getPath(0, id)
+		if err := Lsetxattr(path, LINKSXATTR, []byte(strconv.Itoa(links)), 0); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	// children first, their entries change the times of the parent
+	for i := len(importer.dirtimes) - 1; i >= 0; i-- {
+		id := importer.dirtimes[i]
+		stat := importer.stats[id]
+		path := constor.getPath(0, id)
+		if err := syscall.UtimesNano(path, []syscall.Timespec{stat.Atim, stat.Mtim}); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+func (importer *Importer) run() error {
+	var srcstat, layerstat syscall.Stat_t
+	if err := syscall.Stat(importer.src, &srcstat); err != nil {
+		return err
+	}
+	if err := syscall.Stat(importer.constor.layers[0], &layerstat); err != nil {
+		return err
+	}
+	importer.samefs = srcstat.Dev == layerstat.Dev
+	if err := filepath.Walk(importer.src, importer.scan); err != nil {
+		return err
+	}
+	if err := filepath.Walk(importer.src, importer.walk); err != nil {
+		return err
+	}
+	return importer.finish()
+}
+
+func importmain(args []string) int {
+	opts := defaultoptions()
+	opts.logfile = "-"
+	var o optlist
+	flags := flag.NewFlagSet("constor import", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.Var(&o, "o", "")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Print(IMPORTUSAGE)
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "constor import: %s\n\n%s", err, IMPORTUSAGE)
+		return 1
+	}
+	for _, opt := range o {
+		for _, opt := range strings.Split(opt, ",") {
+			if opt == "" {
+				continue
+			}
+			if err := opts.set(opt); err != nil {
+				fmt.Fprintf(os.Stderr, "constor import: %s\n", err)
+				return 1
+			}
+		}
+	}
+	args = flags.Args()
+	if len(args) != 2 {
+		fmt.Fprint(os.Stderr, IMPORTUSAGE)
+		return 1
+	}
+	src := filepath.Clean(args[0])
+	fi, err := os.Stat(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "constor import: %s\n", err)
+		return 1
+	}
+	if !fi.IsDir() {
+		fmt.Fprintf(os.Stderr, "constor import: %s is not a directory\n", src)
+		return 1
+	}
+	layer := filepath.Clean(args[1])
+	if rel, err := filepath.Rel(src, layer); err == nil && !strings.HasPrefix(rel, "..") {
+		fmt.Fprintf(os.Stderr, "constor import: layer %s is inside %s\n", layer, src)
+		return 1
+	}
+	if err := os.MkdirAll(layer, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "constor import: %s\n", err)
+		return 1
+	}
+	names, err := ioutil.ReadDir(layer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "constor import: %s\n", err)
+		return 1
+	}
+	if len(names) != 0 {
+		fmt.Fprintf(os.Stderr, "constor import: layer %s is not empty\n", layer)
+		return 1
+	}
+	opts.layers = []string{layer}
+	if err := opts.validatelayers(); err != nil {
+		fmt.Fprintf(os.Stderr, "constor import: %s\n", err)
+		return 1
+	}
+	logf, err := openlog(opts.logfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "constor import: unable to open log %s : %s\n", opts.logfile, err)
+		return 1
+	}
+
+	importer := NewImporter(NewConstor(opts, logf), src)
+	if err := importer.run(); err != nil {
+		fmt.Fprintf(os.Stderr, "constor import: %s\n", err)
+		return 1
+	}
+	return 0
+}
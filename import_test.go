@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	Path "path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// imports the tree src into a fresh layer
+func importtree(t *testing.T, src string, whiteout string) (*Constor, error) {
+	layer, err := ioutil.TempDir("", "constor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := defaultoptions()
+	opts.whiteout = whiteout
+	opts.layers = []string{layer}
+	logf, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	constor := NewConstor(opts, logf)
+	return constor, NewImporter(constor, src).run()
+}
+
+// a 0:0 device would turn into a whiteout on a legacy mount
+func TestImportZeroDevice(t *testing.T) {
+	needroot(t)
+	src, err := ioutil.TempDir("", "constor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	if err := syscall.Mknod(Path.Join(src, "dev"), syscall.S_IFCHR|0600, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	constor, err := importtree(t, src, WHITEOUT_LEGACY)
+	removetestconstor(constor)
+	if err == nil || !strings.Contains(err.Error(), "whiteout=strict") {
+		t.Fatalf("legacy import of a 0:0 device returned %v", err)
+	}
+
+	constor, err = importtree(t, src, WHITEOUT_STRICT)
+	defer removetestconstor(constor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := importid("dev")
+	if constor.isdeleted(constor.getPath(0, id), nil) {
+		t.Error("imported 0:0 device is a whiteout")
+	}
+	entry := Path.Join(constor.getPath(0, ROOTID), "dev")
+	if constor.isdeleted(entry, nil) {
+		t.Error("entry of the imported 0:0 device is a whiteout")
+	}
+}
+
+// path below the layer, mode, mtime, id, link count and data of every
+// file, only the objects keep the times of the tree
+func layerfiles(t *testing.T, layer string) map[string]string {
+	files := map[string]string{}
+	err := filepath.Walk(layer, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(layer, path)
+		if err != nil {
+			return err
+		}
+		id, _ := Lgetxattr(path, IDXATTR)
+		links, _ := Lgetxattr(path, LINKSXATTR)
+		data := ""
+		if fi.Mode().IsRegular() {
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			data = string(buf)
+		}
+		mtime := fi.ModTime().UnixNano()
+		if rel == "." || strings.Contains(rel, "/") {
+			// the layer root and the entries are new
+			mtime = 0
+		}
+		files[rel] = fmt.Sprintf("%o %d %s %s %q", fi.Mode(), mtime, id, links, data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestImportTwice(t *testing.T) {
+	needroot(t)
+	src, err := ioutil.TempDir("", "constor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	if err := os.Mkdir(Path.Join(src, "d"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(Path.Join(src, "d", "a"), []byte("data of a"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(Path.Join(src, "h1"), []byte("linked"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(Path.Join(src, "h1"), Path.Join(src, "d", "h2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("d/a", Path.Join(src, "s")); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := importtree(t, src, WHITEOUT_LEGACY)
+	defer removetestconstor(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := importtree(t, src, WHITEOUT_LEGACY)
+	defer removetestconstor(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files1 := layerfiles(t, first.layers[0])
+	files2 := layerfiles(t, second.layers[0])
+	if len(files1) != len(files2) {
+		t.Errorf("imports have %d and %d files", len(files1), len(files2))
+	}
+	for rel, file := range files1 {
+		if files2[rel] != file {
+			t.Errorf("%s is %s in the first import and %s in the second", rel, file, files2[rel])
+		}
+	}
+
+	root := first.getPath(0, ROOTID)
+	h1, err := Lgetxattr(Path.Join(root, "h1"), IDXATTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Lgetxattr(Path.Join(root, "d"), IDXATTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := Lgetxattr(Path.Join(first.getPath(0, string(d)), "h2"), IDXATTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(h1) != string(h2) {
+		t.Fatalf("hard links have the ids %s and %s", h1, h2)
+	}
+	if links, _ := Lgetxattr(first.getPath(0, string(h1)), LINKSXATTR); string(links) != "2" {
+		t.Errorf("hard linked object has %q links", links)
+	}
+	if data, _ := ioutil.ReadFile(first.getPath(0, string(h1))); string(data) != "linked" {
+		t.Errorf("hard linked object holds %q", data)
+	}
+}
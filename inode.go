@@ -5,14 +5,29 @@ import (
 	"unsafe"
 )
 
-// FIXME: lock is not held whenever layer is modified
-// for now all this runs in single go routine so it's all fine
+// go-fuse serves requests concurrently. Locks are taken in this order:
+//
+//	Inode.dirmu     held while the entries of a directory change, Rename
+//	                takes both parents with lockdirs
+//	Inode.layermu   held across a change of layer: copyup and the removal
+//	                of the object. Never held while taking a dirmu, and
+//	                only one at a time.
+//	Constor.Mutex   guards inodemap, fdmap and copyupcalls
+//	FD              write locked to switch an open file to layer0, read
+//	                locked around I/O on it. copyup is never called with
+//	                it held, copyups of the same inode wait for each other
+//	                without holding any lock.
+//	Inode.Mutex     guards nlookup, layer and parent
 
 type Inode struct {
 	nlookup uint64
 	id	string
 	layer   int
+	// id of the directory this inode was last looked up in, used for ".."
+	parent  string
 	sync.Mutex
+	layermu sync.Mutex
+	dirmu   sync.Mutex
 	constor *Constor
 }
 
@@ -35,6 +50,50 @@ func (inode *Inode) forget(n uint64) {
 	}
 }
 
+func (inode *Inode) getlayer() int {
+	inode.Lock()
+	defer inode.Unlock()
+	return inode.layer
+}
+
+func (inode *Inode) setlayer(li int) {
+	inode.Lock()
+	defer inode.Unlock()
+	inode.layer = li
+}
+
+func (inode *Inode) getparent() string {
+	inode.Lock()
+	defer inode.Unlock()
+	return inode.parent
+}
+
+func (inode *Inode) setparent(id string) {
+	inode.Lock()
+	defer inode.Unlock()
+	inode.parent = id
+}
+
+// locks the entries of two directories in id order, for Rename
+func lockdirs(a *Inode, b *Inode) {
+	if a == b {
+		a.dirmu.Lock()
+		return
+	}
+	if b.id < a.id {
+		a, b = b, a
+	}
+	a.dirmu.Lock()
+	b.dirmu.Lock()
+}
+
+func unlockdirs(a *Inode, b *Inode) {
+	a.dirmu.Unlock()
+	if b != a {
+		b.dirmu.Unlock()
+	}
+}
+
 func NewInode(constor *Constor, id string) *Inode {
 	inode := new(Inode)
 	inode.constor = constor
@@ -57,6 +116,7 @@ func NewInodemap(constor *Constor) *Inodemap {
 	inodemap.idmap = make(map[string]*Inode)
 
 	inode := NewInode(constor, ROOTID)
+	inode.parent = ROOTID
 	inodemap.hashInode(inode)
 	return inodemap
 }
@@ -81,6 +141,29 @@ func (inodemap *Inodemap) findInodeId(id string) (*Inode) {
 	return nil
 }
 
+// returns the inode of id with a lookup reference taken, a new inode
+// starts out in layer li. Two lookups of the same id racing each other
+// get the same inode.
+func (inodemap *Inodemap) lookupInode(id string, li int, parent string) *Inode {
+	inodemap.constor.Lock()
+	defer inodemap.constor.Unlock()
+	inode, ok := inodemap.idmap[id]
+	if ok {
+		inode.Lock()
+		inode.nlookup++
+		inode.parent = parent
+		inode.Unlock()
+		return inode
+	}
+	inode = NewInode(inodemap.constor, id)
+	inode.layer = li
+	inode.parent = parent
+	ptr := uint64(uintptr(unsafe.Pointer(inode)))
+	inodemap.ptrmap[ptr] = inode
+	inodemap.idmap[id] = inode
+	return inode
+}
+
 func (inodemap *Inodemap) hashInode(inode *Inode) {
 	inodemap.constor.Lock()
 	defer inodemap.constor.Unlock()
@@ -100,7 +183,16 @@ func (inodemap *Inodemap) unhashInode(inode *Inode) {
 	if inode.id == ROOTID {
 		return
 	}
+	// a lookup may have raced in since the last reference was dropped
+	inode.Lock()
+	n := inode.nlookup
+	inode.Unlock()
+	if n != 0 {
+		return
+	}
 	ptr := uint64(uintptr(unsafe.Pointer(inode)))
 	delete(inodemap.ptrmap, ptr)
-	delete(inodemap.idmap, inode.id)
+	if inodemap.idmap[inode.id] == inode {
+		delete(inodemap.idmap, inode.id)
+	}
 }
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Instrumented is the RawFileSystem handed to the FUSE server. Each
+// operation is passed on to Constor, accounted in the metrics and written
+// to the trace when tracing. Calls that Constor makes to itself, like the
+// Lookup at the end of Mkdir, are not accounted again.
+type Instrumented struct {
+	*Constor
+}
+
+func (fs *Instrumented) Lookup(header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	rec := fs.opbegin("Lookup", header)
+	rec.Name = name
+	code := fs.Constor.Lookup(header, name, out)
+	rec.OutNode = out.NodeId
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Forget(nodeID uint64, nlookup uint64) {
+	rec := fs.opbegin("Forget", &fuse.InHeader{NodeId: nodeID})
+	rec.Size = nlookup
+	fs.Constor.Forget(nodeID, nlookup)
+	fs.opend(rec, fuse.OK)
+}
+
+func (fs *Instrumented) GetAttr(input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	rec := fs.opbegin("GetAttr", &input.InHeader)
+	rec.Flags = input.Flags()
+	if rec.Flags&fuse.FUSE_GETATTR_FH != 0 {
+		rec.Fh = input.Fh()
+	}
+	code := fs.Constor.GetAttr(input, out)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) SetAttr(input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	rec := fs.opbegin("SetAttr", &input.InHeader)
+	rec.Valid = input.Valid
+	rec.Fh = input.Fh
+	rec.Size = input.Size
+	rec.Mode = input.Mode
+	rec.AttrUid = input.Uid
+	rec.AttrGid = input.Gid
+	rec.Atime = input.Atime
+	rec.Atimensec = input.Atimensec
+	rec.Mtime = input.Mtime
+	rec.Mtimensec = input.Mtimensec
+	code := fs.Constor.SetAttr(input, out)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Mknod(input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	rec := fs.opbegin("Mknod", &input.InHeader)
+	rec.Name = name
+	rec.Mode = input.Mode
+	rec.Rdev = input.Rdev
+	code := fs.Constor.Mknod(input, name, out)
+	rec.OutNode = out.NodeId
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Mkdir(input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	rec := fs.opbegin("Mkdir", &input.InHeader)
+	rec.Name = name
+	rec.Mode = input.Mode
+	code := fs.Constor.Mkdir(input, name, out)
+	rec.OutNode = out.NodeId
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Unlink(header *fuse.InHeader, name string) fuse.Status {
+	rec := fs.opbegin("Unlink", header)
+	rec.Name = name
+	code := fs.Constor.Unlink(header, name)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Rmdir(header *fuse.InHeader, name string) fuse.Status {
+	rec := fs.opbegin("Rmdir", header)
+	rec.Name = name
+	code := fs.Constor.Rmdir(header, name)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Rename(input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	rec := fs.opbegin("Rename", &input.InHeader)
+	rec.Name = oldName
+	rec.Name2 = newName
+	rec.Node2 = input.Newdir
+	rec.Id2 = fs.traceid(input.Newdir)
+	rec.Flags = input.Flags
+	code := fs.Constor.Rename(input, oldName, newName)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Link(input *fuse.LinkIn, name string, out *fuse.EntryOut) fuse.Status {
+	rec := fs.opbegin("Link", &input.InHeader)
+	rec.Name = name
+	rec.Node2 = input.Oldnodeid
+	rec.Id2 = fs.traceid(input.Oldnodeid)
+	code := fs.Constor.Link(input, name, out)
+	rec.OutNode = out.NodeId
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Symlink(header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	rec := fs.opbegin("Symlink", header)
+	rec.Name = linkName
+	rec.Name2 = pointedTo
+	code := fs.Constor.Symlink(header, pointedTo, linkName, out)
+	rec.OutNode = out.NodeId
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Readlink(header *fuse.InHeader) ([]byte, fuse.Status) {
+	rec := fs.opbegin("Readlink", header)
+	res, code := fs.Constor.Readlink(header)
+	fs.opend(rec, code)
+	return res, code
+}
+
+func (fs *Instrumented) Access(input *fuse.AccessIn) fuse.Status {
+	rec := fs.opbegin("Access", &input.InHeader)
+	rec.Flags = input.Mask
+	code := fs.Constor.Access(input)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) GetXAttrSize(header *fuse.InHeader, attr string) (int, fuse.Status) {
+	rec := fs.opbegin("GetXAttrSize", header)
+	rec.Name = attr
+	res, code := fs.Constor.GetXAttrSize(header, attr)
+	fs.opend(rec, code)
+	return res, code
+}
+
+func (fs *Instrumented) GetXAttrData(header *fuse.InHeader, attr string) ([]byte, fuse.Status) {
+	rec := fs.opbegin("GetXAttrData", header)
+	rec.Name = attr
+	res, code := fs.Constor.GetXAttrData(header, attr)
+	fs.opend(rec, code)
+	return res, code
+}
+
+func (fs *Instrumented) ListXAttr(header *fuse.InHeader) ([]byte, fuse.Status) {
+	rec := fs.opbegin("ListXAttr", header)
+	res, code := fs.Constor.ListXAttr(header)
+	fs.opend(rec, code)
+	return res, code
+}
+
+func (fs *Instrumented) SetXAttr(input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	rec := fs.opbegin("SetXAttr", &input.InHeader)
+	rec.Name = attr
+	rec.Flags = input.Flags
+	rec.Data = data
+	code := fs.Constor.SetXAttr(input, attr, data)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) RemoveXAttr(header *fuse.InHeader, attr string) fuse.Status {
+	rec := fs.opbegin("RemoveXAttr", header)
+	rec.Name = attr
+	code := fs.Constor.RemoveXAttr(header, attr)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Create(input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	rec := fs.opbegin("Create", &input.InHeader)
+	rec.Name = name
+	rec.Flags = input.Flags
+	rec.Mode = input.Mode
+	code := fs.Constor.Create(input, name, out)
+	rec.OutNode = out.NodeId
+	rec.OutFh = out.Fh
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Open(input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	rec := fs.opbegin("Open", &input.InHeader)
+	rec.Flags = input.Flags
+	code := fs.Constor.Open(input, out)
+	rec.OutFh = out.Fh
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Read(input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	rec := fs.opbegin("Read", &input.InHeader)
+	rec.Fh = input.Fh
+	rec.Off = input.Offset
+	rec.Size = uint64(input.Size)
+	res, code := fs.Constor.Read(input, buf)
+	fs.opend(rec, code)
+	return res, code
+}
+
+func (fs *Instrumented) Release(input *fuse.ReleaseIn) {
+	rec := fs.opbegin("Release", &input.InHeader)
+	rec.Fh = input.Fh
+	rec.Flags = input.Flags
+	fs.Constor.Release(input)
+	fs.opend(rec, fuse.OK)
+}
+
+func (fs *Instrumented) Write(input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	rec := fs.opbegin("Write", &input.InHeader)
+	rec.Fh = input.Fh
+	rec.Off = input.Offset
+	rec.Size = uint64(input.Size)
+	res, code := fs.Constor.Write(input, data)
+	fs.opend(rec, code)
+	return res, code
+}
+
+func (fs *Instrumented) Flush(input *fuse.FlushIn) fuse.Status {
+	rec := fs.opbegin("Flush", &input.InHeader)
+	rec.Fh = input.Fh
+	code := fs.Constor.Flush(input)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Fsync(input *fuse.FsyncIn) fuse.Status {
+	rec := fs.opbegin("Fsync", &input.InHeader)
+	rec.Fh = input.Fh
+	rec.Flags = input.FsyncFlags
+	code := fs.Constor.Fsync(input)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) Fallocate(input *fuse.FallocateIn) fuse.Status {
+	rec := fs.opbegin("Fallocate", &input.InHeader)
+	rec.Fh = input.Fh
+	rec.Off = input.Offset
+	rec.Size = input.Length
+	rec.Mode = input.Mode
+	code := fs.Constor.Fallocate(input)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) OpenDir(input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	rec := fs.opbegin("OpenDir", &input.InHeader)
+	rec.Flags = input.Flags
+	code := fs.Constor.OpenDir(input, out)
+	rec.OutFh = out.Fh
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) ReadDir(input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	rec := fs.opbegin("ReadDir", &input.InHeader)
+	rec.Fh = input.Fh
+	rec.Off = input.Offset
+	rec.Size = uint64(input.Size)
+	code := fs.Constor.ReadDir(input, out)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) ReadDirPlus(input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	rec := fs.opbegin("ReadDirPlus", &input.InHeader)
+	rec.Fh = input.Fh
+	rec.Off = input.Offset
+	rec.Size = uint64(input.Size)
+	code := fs.Constor.ReadDirPlus(input, out)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) ReleaseDir(input *fuse.ReleaseIn) {
+	rec := fs.opbegin("ReleaseDir", &input.InHeader)
+	rec.Fh = input.Fh
+	rec.Flags = input.Flags
+	fs.Constor.ReleaseDir(input)
+	fs.opend(rec, fuse.OK)
+}
+
+func (fs *Instrumented) FsyncDir(input *fuse.FsyncIn) fuse.Status {
+	rec := fs.opbegin("FsyncDir", &input.InHeader)
+	rec.Fh = input.Fh
+	rec.Flags = input.FsyncFlags
+	code := fs.Constor.FsyncDir(input)
+	fs.opend(rec, code)
+	return code
+}
+
+func (fs *Instrumented) StatFs(header *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	rec := fs.opbegin("StatFs", header)
+	code := fs.Constor.StatFs(header, out)
+	fs.opend(rec, code)
+	return code
+}
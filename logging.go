@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	Path "path"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// log levels, a message is written when its level is <= the current level
+const (
+	LOG_ERROR = iota
+	LOG_WARN
+	LOG_INFO
+	LOG_DEBUG
+	LOG_TRACE
+)
+
+var LOGLEVELS = []string{"error", "warn", "info", "debug", "trace"}
+
+func parseloglevel(name string) (int32, error) {
+	for i, level := range LOGLEVELS {
+		if name == level {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("log level must be one of %s, got %q", strings.Join(LOGLEVELS, ", "), name)
+}
+
+type logentry struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Op    string `json:"op"`
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+	Msg   string `json:"msg"`
+}
+
+func (constor *Constor) getloglevel() string {
+	return LOGLEVELS[atomic.LoadInt32(&constor.loglevel)]
+}
+
+func (constor *Constor) setloglevel(name string) error {
+	level, err := parseloglevel(name)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&constor.loglevel, level)
+	return nil
+}
+
+// restricts messages below error to the given operations, e.g. "Lookup"
+// or "copyup". No operations means no restriction.
+func (constor *Constor) setlogops(ops []string) {
+	constor.logmu.Lock()
+	defer constor.logmu.Unlock()
+	constor.logops = map[string]bool{}
+	for _, op := range ops {
+		constor.logops[op] = true
+	}
+}
+
+func (constor *Constor) getlogops() []string {
+	constor.logmu.Lock()
+	defer constor.logmu.Unlock()
+	ops := []string{}
+	for op, _ := range constor.logops {
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func (constor *Constor) logmsg(level int32, format string, a ...interface{}) {
+	if level > atomic.LoadInt32(&constor.loglevel) {
+		return
+	}
+	pc, file, line, _ := runtime.Caller(2)
+	funcName := runtime.FuncForPC(pc).Name()
+	op := funcName[strings.LastIndex(funcName, ".")+1:]
+	info := fmt.Sprintf(format, a...)
+	now := time.Now().Format(time.RFC3339Nano)
+
+	constor.logmu.Lock()
+	defer constor.logmu.Unlock()
+	if level > LOG_ERROR && len(constor.logops) > 0 && !constor.logops[op] {
+		return
+	}
+	if constor.logjson {
+		entry := logentry{
+			Time:  now,
+			Level: LOGLEVELS[level],
+			Op:    op,
+			File:  Path.Base(file),
+			Line:  line,
+			Msg:   info,
+		}
+		buf, err := json.Marshal(&entry)
+		if err != nil {
+			return
+		}
+		constor.logf.Write(append(buf, '\n'))
+		return
+	}
+	fmt.Fprintf(constor.logf, "%s %s %s:%d:%s %v\n", now, strings.ToUpper(LOGLEVELS[level]), Path.Base(file), line, funcName, info)
+}
+
+func (constor *Constor) error(format string, a ...interface{}) {
+	constor.logmsg(LOG_ERROR, format, a...)
+}
+
+func (constor *Constor) warn(format string, a ...interface{}) {
+	constor.logmsg(LOG_WARN, format, a...)
+}
+
+func (constor *Constor) info(format string, a ...interface{}) {
+	constor.logmsg(LOG_INFO, format, a...)
+}
+
+func (constor *Constor) log(format string, a ...interface{}) {
+	constor.logmsg(LOG_DEBUG, format, a...)
+}
+
+func (constor *Constor) trace(format string, a ...interface{}) {
+	constor.logmsg(LOG_TRACE, format, a...)
+}
+
+func openlog(path string) (*os.File, error) {
+	if path == "-" || path == "stderr" {
+		return os.Stderr, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// reopens the log file, for log rotation
+func (constor *Constor) reopenlog() error {
+	logf, err := openlog(constor.logpath)
+	if err != nil {
+		return err
+	}
+	constor.logmu.Lock()
+	old := constor.logf
+	constor.logf = logf
+	constor.logmu.Unlock()
+	if old != os.Stderr {
+		old.Close()
+	}
+	return nil
+}
+
+// SIGUSR1 raises and SIGUSR2 lowers the log level by one, SIGHUP reopens
+// the log file and resets the level to the one given at mount time
+func (constor *Constor) handlelogsignals(level int32) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigs {
+			cur := atomic.LoadInt32(&constor.loglevel)
+			switch sig {
+			case syscall.SIGHUP:
+				if err := constor.reopenlog(); err != nil {
+					constor.error("unable to reopen %s : %s", constor.logpath, err)
+				}
+				cur = level
+			case syscall.SIGUSR1:
+				if cur < LOG_TRACE {
+					cur++
+				}
+			case syscall.SIGUSR2:
+				if cur > LOG_ERROR {
+					cur--
+				}
+			}
+			atomic.StoreInt32(&constor.loglevel, cur)
+			constor.info("log level is %s", LOGLEVELS[cur])
+		}
+	}()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// the logops example of the usage text logs exactly these operations
+func TestLogOps(t *testing.T) {
+	needroot(t)
+	opts := defaultoptions()
+	for _, opt := range []string{"loglevel=debug", "logformat=json", "logops=Lookup:Rename:copyup"} {
+		if err := opts.set(opt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	constor := newtestconstor(t, WHITEOUT_LEGACY)
+	defer removetestconstor(constor)
+	logf, err := ioutil.TempFile("", "constor.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(logf.Name())
+	constor.logf.Close()
+	constor.logf = logf
+	constor.loglevel = opts.loglevel
+	constor.logjson = opts.logjson
+	constor.setlogops(opts.logops)
+
+	if err := os.Mkdir(constor.getPath(1, ROOTID), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mklowerfile(t, constor, "f")
+	root := fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+	var f fuse.EntryOut
+	if code := constor.Lookup(&root, "f", &f); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := constor.Rename(&fuse.RenameIn{InHeader: root, Newdir: fuse.FUSE_ROOT_ID}, "f", "g"); !code.Ok() {
+		t.Fatal(code)
+	}
+	var o fuse.OpenOut
+	if code := constor.Open(&fuse.OpenIn{InHeader: fuse.InHeader{NodeId: f.NodeId}, Flags: uint32(os.O_WRONLY | os.O_TRUNC)}, &o); !code.Ok() {
+		t.Fatal(code)
+	}
+	constor.Release(&fuse.ReleaseIn{Fh: o.Fh})
+	var d fuse.EntryOut
+	if code := constor.Mkdir(&fuse.MkdirIn{InHeader: root, Mode: 0755}, "d", &d); !code.Ok() {
+		t.Fatal(code)
+	}
+
+	if _, err := logf.Seek(0, os.SEEK_SET); err != nil {
+		t.Fatal(err)
+	}
+	logged := map[string]bool{}
+	scanner := bufio.NewScanner(logf)
+	for scanner.Scan() {
+		var entry logentry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("%q : %s", scanner.Text(), err)
+		}
+		logged[entry.Op] = true
+	}
+	for _, op := range []string{"Lookup", "Rename", "copyup"} {
+		if !logged[op] {
+			t.Errorf("%s was not logged", op)
+		}
+		delete(logged, op)
+	}
+	for op, _ := range logged {
+		t.Errorf("%s was logged", op)
+	}
+}
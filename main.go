@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net"
 	"os"
 	Path "path"
 	"strings"
@@ -21,13 +23,58 @@ const DELXATTR = "trusted.constor.deleted"
 const LINKSXATTR = "trusted.constor.links"
 const ROOTID = "00000000000000000000000000000001"
 
+// whiteout formats, a whiteout is a 0:0 char device placed over an entry
+const (
+	// any 0:0 char device is a whiteout
+	WHITEOUT_LEGACY = "legacy"
+	// only 0:0 char devices that also carry DELXATTR are whiteouts
+	WHITEOUT_STRICT = "strict"
+)
+
+// renameat2(2) flags
+const (
+	RENAME_NOREPLACE = 1
+	RENAME_EXCHANGE  = 2
+)
+
+// access(2) mask bits
+const (
+	R_OK = 4
+	W_OK = 2
+	X_OK = 1
+)
+
 type Constor struct {
 	sync.Mutex
 	logf	  *os.File
+	logpath   string
+	// guards logf, logjson and logops
+	logmu     sync.Mutex
+	loglevel  int32
+	logjson   bool
+	logops    map[string]bool
+	// the control socket listener, see servectl
+	ctl       net.Listener
 	inodemap  *Inodemap
 	fdmap     map[uintptr]*FD
+	// the open files in fdmap by id and by id and pid, see putfd
+	fdids     map[string][]*FD
+	fdpids    map[fdkey][]*FD
 	layers    []string
 	ms 		  *fuse.Server
+	// copyups in flight by inode id
+	copyupcalls map[string]*copyupcall
+	// exported on /metrics, see metrics.go
+	metrics   *Metrics
+	// records every operation when tracing, see trace.go
+	tracer    *Tracer
+	// xattr namespaces carried over on copyup, see xattrallowed
+	xattrallow []string
+	xattrdeny  []string
+	whiteout   string
+	entrytimeout time.Duration
+	attrtimeout  time.Duration
+	readonly   bool
 }
 
 func (constor *Constor) Lookup(header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
@@ -49,9 +96,8 @@ func (constor *Constor) Lookup(header *fuse.InHeader, name string, out *fuse.Ent
 		// lookps on non-existant files
 		return fuse.ToStatus(err)
 	}
-	inode := constor.inodemap.findInodeId(id)
-	if inode != nil {
-		li = inode.layer
+	if inode := constor.inodemap.findInodeId(id); inode != nil {
+		li = inode.getlayer()
 	} else {
 		li = constor.getLayer(id)
 	}
@@ -64,19 +110,13 @@ func (constor *Constor) Lookup(header *fuse.InHeader, name string, out *fuse.Ent
 		constor.error("Unable to Lstat inode for %s(%s) id %s", parent.id, name, id)
 		return fuse.ToStatus(err)
 	}
-	if inode == nil {
-		inode = NewInode(constor, id)
-		inode.layer = li
-		constor.inodemap.hashInode(inode)
-	} else {
-		inode.lookup()
-	}
+	inode := constor.inodemap.lookupInode(id, li, parent.id)
 	attr := (*fuse.Attr)(&out.Attr)
 	attr.FromStat(&stat)
 	out.NodeId = uint64(uintptr(unsafe.Pointer(inode)))
 	out.Ino = attr.Ino
-	out.EntryValid = 1000
-	out.AttrValid = 1000
+	out.SetEntryTimeout(constor.entrytimeout)
+	out.SetAttrTimeout(constor.attrtimeout)
 	constor.log("%s", id)
 	return fuse.OK
 }
@@ -85,6 +125,9 @@ func (constor *Constor) Forget(nodeID uint64, nlookup uint64) {
 	if inode := constor.inodemap.findInodePtr(nodeID); inode != nil {
 		constor.log("%s %d", inode.id, nlookup)
 		inode.forget(nlookup)
+		if inode.getlayer() == -1 {
+			constor.reclaimorphan(inode.id)
+		}
 	}
 }
 
@@ -95,26 +138,41 @@ func (constor *Constor) GetAttr(input *fuse.GetAttrIn, out *fuse.AttrOut) (code
 		constor.error("%d not in inodemap", input.NodeId)
 		return fuse.ENOENT
 	}
-	if inode.id == ROOTID && inode.layer == -1 {
-		inode.layer = constor.getLayer(inode.id)
-		if inode.layer == -1 {
+	li := inode.getlayer()
+	if inode.id == ROOTID && li == -1 {
+		li = constor.getLayer(inode.id)
+		if li == -1 {
 			constor.error("Unable to find root inode")
 			return fuse.ENOENT
 		}
+		inode.setlayer(li)
+	}
+	// fstat(2) hands over its file, stat(2) on a file the caller has
+	// open is served from the fd too
+	var F *FD
+	if input.Flags() & fuse.FUSE_GETATTR_FH != 0 {
+		F = constor.getfd(uintptr(input.Fh()))
+		if F != nil && (F.stream != nil || F.id != inode.id) {
+			F = nil
+		}
+	}
+	if F == nil {
+		F = constor.fdlookup(inode.id, input.Pid)
 	}
-	F := constor.fdlookup(inode.id, input.Pid)
 	var err error
 	// FIXME check to see if F.layer needs to be changed
 	if F == nil  {
-		if inode.layer == -1 {
+		if li == -1 {
 			constor.error("layer is -1 for %s", inode.id)
 			return fuse.ENOENT
 		}
 		constor.log("Lstat on %s", inode.id)
-		err = constor.Lstat(inode.layer, inode.id, &stat)
+		err = constor.Lstat(li, inode.id, &stat)
 	} else {
 		constor.log("Fstat on %s", inode.id)
+		F.RLock()
 		err = syscall.Fstat(F.fd, &stat)
+		F.RUnlock()
 		stat.Ino = idtoino(F.id)
 		// FIXME take care of hard links too
 	}
@@ -124,7 +182,7 @@ func (constor *Constor) GetAttr(input *fuse.GetAttrIn, out *fuse.AttrOut) (code
 	}
 	attr := (*fuse.Attr)(&out.Attr)
 	attr.FromStat(&stat)
-	out.AttrValid = 1000
+	out.SetTimeout(constor.attrtimeout)
 	constor.log("%s", inode.id)
 	return fuse.OK
 }
@@ -168,7 +226,6 @@ func (constor *Constor) OpenDir(input *fuse.OpenIn, out *fuse.OpenOut) (code fus
 			}
 			d := DirEntry {
 				Name: name,
-				Mode: uint32(infos[i].Mode()),
 			}
 			if constor.isdeleted(Path.Join(path, name), infos[i].Sys().(*syscall.Stat_t)) {
 				d.Deleted = true
@@ -178,8 +235,15 @@ func (constor *Constor) OpenDir(input *fuse.OpenIn, out *fuse.OpenOut) (code fus
 					constor.error("getid failed on %d %s %s", li, inode.id, name)
 					continue;
 				}
+				// the entry is only a placeholder, the type comes from the object
+				mode, err := constor.idtype(id)
+				if err != nil {
+					constor.error("idtype failed on %s %s : %s", inode.id, name, err)
+					continue;
+				}
 				d.Ino = idtoino(id)
-
+				d.Id = id
+				d.Mode = mode
 			}
 			entries[name] = d
 		}
@@ -197,26 +261,34 @@ func (constor *Constor) OpenDir(input *fuse.OpenIn, out *fuse.OpenOut) (code fus
 		Name: ".",
 		Mode: syscall.S_IFDIR,
 		Ino: idtoino(inode.id),
+		Id: inode.id,
 	}
 	output = append(output, d)
 
-	// FIXME: take care of ".." entry
-	// err = constor.Lstat(Path.Join(path, ".."), &stat)
-	// d = DirEntry{
-	// 	Name: "..",
-	// 	Mode: syscall.S_IFDIR,
-	// }
-	// output = append(output, d)
+	parentid := inode.getparent()
+	if parentid == "" {
+		constor.error("parent unknown for %s", inode.id)
+		parentid = inode.id
+	}
+	d = DirEntry{
+		Name: "..",
+		Mode: syscall.S_IFDIR,
+		Ino: idtoino(parentid),
+		Id: parentid,
+	}
+	output = append(output, d)
 
 	for i, _ := range output {
 		output[i].Offset = uint64(i) + 1
 	}
-	fmt.Println(output)
+	constor.trace("%s %v", inode.id, output)
 	F := new(FD)
 	if F == nil {
 		return fuse.ToStatus(syscall.ENOMEM)
 	}
 	F.stream = output
+	F.id = inode.id
+	F.layer = inode.getlayer()
 	constor.putfd(F)
 	out.Fh = uint64(uintptr(unsafe.Pointer(F)))
 	out.OpenFlags = 0
@@ -309,43 +381,39 @@ func (constor *Constor) SetAttr(input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.S
 			constor.error("F == nil for %s", inode.id)
 			return fuse.EIO
 		}
-		if F.layer != 0 && inode.layer == -1 {
-			/* FIXME handle this valid case */
-			// file is in lower layer, opened, deleted, setattr-called
-			constor.error("FSetAttr F.layer=%d inode.layer=%d", F.layer, inode.layer)
-			return fuse.EIO
+		li := inode.getlayer()
+		F.RLock()
+		flayer := F.layer
+		F.RUnlock()
+		if flayer != 0 && F.flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+			// nothing to copy for a truncate that fails anyway
+			return fuse.EINVAL
 		}
-
-		if F.layer != 0 && inode.layer != 0 {
-			err := constor.copyup(inode)
-			if err != nil {
-				constor.error("copyup failed for %s - %s", inode.id, err)
+		if flayer != 0 && li == -1 {
+			// file is in lower layer, opened, deleted, setattr-called
+			if err := constor.orphanup(inode); err != nil {
+				constor.error("orphanup failed for %s - %s", inode.id, err)
 				return fuse.ToStatus(err)
 			}
-			path := constor.getPath(0, inode.id)
-			syscall.Close(F.fd)
-			fd, err := syscall.Open(path, F.flags, 0)
+		} else if flayer != 0 {
+			// a copyup by some other process only needs the fd reset
+			var err error
+			if input.Size == 0 {
+				err = constor.copyupempty(inode)
+			} else {
+				err = constor.copyup(inode)
+			}
 			if err != nil {
-				constor.error("open failed on %s - %s", path, err)
+				constor.error("copyup failed for %s - %s", inode.id, err)
 				return fuse.ToStatus(err)
 			}
-			F.fd = fd
-			F.layer = 0
-			constor.log("reset fd for %s", path)
-		} else if F.layer != 0 && inode.layer == 0 {
-			// when some other process already has done a copyup
-			syscall.Close(F.fd)
-			path := constor.getPath(0, inode.id)
-			fd, err := syscall.Open(path, F.flags, 0)
-			if err != nil {
-				constor.error("open failed on %s - %s", path, err)
+			if err := constor.fdswitch(F, inode); err != nil {
 				return fuse.ToStatus(err)
 			}
-			F.fd = fd
-			F.layer = 0
-			constor.log("reset fd for %s", path)
 		}
 
+		F.RLock()
+		defer F.RUnlock()
 		if F.layer != 0 {
 			constor.error("layer not 0")
 			return fuse.EIO
@@ -421,12 +489,17 @@ func (constor *Constor) SetAttr(input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.S
 		return fuse.OK
 	}
 
-	if inode.layer == -1 {
+	if inode.getlayer() == -1 {
 		return fuse.ENOENT
 	}
 
-	if inode.layer != 0 {
-		err = constor.copyup(inode)
+	if inode.getlayer() != 0 {
+		if input.Valid&fuse.FATTR_SIZE != 0 && input.Size == 0 {
+			// the kernel only truncates regular files
+			err = constor.copyupempty(inode)
+		} else {
+			err = constor.copyup(inode)
+		}
 		if err != nil {
 			constor.error("copyup failed for %s - %s", inode.id, err)
 			return fuse.ToStatus(err)
@@ -508,7 +581,7 @@ func (constor *Constor) SetAttr(input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.S
 	}
 	attr := (*fuse.Attr)(&out.Attr)
 
-	err = constor.Lstat(inode.layer, inode.id, &stat)
+	err = constor.Lstat(inode.getlayer(), inode.id, &stat)
 	if err != nil {
 		constor.error("Lstat failed on %s : %s", inode.id, err)
 		return fuse.ToStatus(err)
@@ -525,7 +598,7 @@ func (constor *Constor) Readlink(header *fuse.InHeader) (out []byte, code fuse.S
 		return nil, fuse.ENOENT
 	}
 	constor.log("%s", inode.id)
-	path := constor.getPath(inode.layer, inode.id)
+	path := constor.getPath(inode.getlayer(), inode.id)
 	link, err := os.Readlink(path)
 	if err != nil {
 		constor.error("Failed on %s : %s", path, err)
@@ -541,19 +614,23 @@ func (constor *Constor) Mknod(input *fuse.MknodIn, name string, out *fuse.EntryO
 		return fuse.ENOENT
 	}
 	constor.log("%s %s", inode.id, name)
+	inode.dirmu.Lock()
+	defer inode.dirmu.Unlock()
 	err := constor.copyup(inode)
 	if err != nil {
-		constor.error("copyup failed on %s : ", inode.id, err)
+		constor.error("copyup failed on %s : %s", inode.id, err)
 		return fuse.ToStatus(err)
 	}
 	dirpath := constor.getPath(0, inode.id)
 	entrypath := Path.Join(dirpath, name)
 	syscall.Unlink(entrypath) // remove a deleted entry
-	err = syscall.Mknod(entrypath, input.Mode, int(input.Rdev))
+	// the entry is a regular file so it can never be mistaken for a whiteout
+	fd, err := syscall.Creat(entrypath, input.Mode&07777)
 	if err != nil {
 		constor.error("Failed on %s : %s", entrypath, err)
 		return fuse.ToStatus(err)
 	}
+	syscall.Close(fd)
 	id := constor.setid(entrypath, "")
 	if id == "" {
 		constor.error("setid failed on %s", entrypath)
@@ -584,9 +661,11 @@ func (constor *Constor) Mkdir(input *fuse.MkdirIn, name string, out *fuse.EntryO
 		return fuse.ENOENT
 	}
 	constor.log("%s %s", inode.id, name)
+	inode.dirmu.Lock()
+	defer inode.dirmu.Unlock()
 	err := constor.copyup(inode)
 	if err != nil {
-		constor.error("copyup failed on %s : ", inode.id, err)
+		constor.error("copyup failed on %s : %s", inode.id, err)
 		return fuse.ToStatus(err)
 	}
 	dirpath := constor.getPath(0, inode.id)
@@ -629,6 +708,8 @@ func (constor *Constor) Unlink(header *fuse.InHeader, name string) (code fuse.St
 		return fuse.ENOENT
 	}
 	constor.log("%s %s", parent.id, name)
+	parent.dirmu.Lock()
+	defer parent.dirmu.Unlock()
 	id, err := constor.getid(-1, parent.id, name)
 	if err != nil {
 		constor.error("getid failed %s %s", parent.id, name)
@@ -639,24 +720,12 @@ func (constor *Constor) Unlink(header *fuse.InHeader, name string) (code fuse.St
 		constor.error("%s %s : inode == nil", parent.id, name)
 		return fuse.ENOENT
 	}
-	if inode.layer == 0 {
-		linkcnt, err := constor.declinkscnt(inode.id)
-		if err != nil {
-			constor.error("declinkscnt %s : %s", inode.id, err)
-			return fuse.ToStatus(err)
-		}
-		if linkcnt == 0 {
-			path := constor.getPath(0, inode.id)
-			if err := syscall.Unlink(path); err != nil {
-				constor.error("Unlink failed for %s : %s", path, err)
-				return fuse.ToStatus(err)
-			}
-			inode.layer = -1
-		}
+	if err := constor.unlinkobject(inode); err != nil {
+		return fuse.ToStatus(err)
 	}
 	err = constor.copyup(parent)
 	if err != nil {
-		constor.error("copyup failed on %s : ", parent.id, err)
+		constor.error("copyup failed on %s : %s", parent.id, err)
 		return fuse.ToStatus(err)
 	}
 	// if there is an entry path, delete it
@@ -683,6 +752,8 @@ func (constor *Constor) Rmdir(header *fuse.InHeader, name string) (code fuse.Sta
 		return fuse.ENOENT
 	}
 	constor.log("%s %s", parent.id, name)
+	parent.dirmu.Lock()
+	defer parent.dirmu.Unlock()
 	id, err := constor.getid(-1, parent.id, name)
 	if err != nil {
 		constor.error("getid failed %s %s", parent.id, name)
@@ -694,74 +765,13 @@ func (constor *Constor) Rmdir(header *fuse.InHeader, name string) (code fuse.Sta
 		return fuse.ENOENT
 	}
 
-	entries := map[string]DirEntry{}
-	for li, _ := range constor.layers {
-		path := constor.getPath(li, inode.id)
-		stat := syscall.Stat_t{}
-		err := syscall.Lstat(path, &stat)
-		if err != nil {
-			// this means that the directory was created on the layer above this layer
-			break
-		}
-		if (stat.Mode & syscall.S_IFMT) != syscall.S_IFDIR {
-			constor.error("Not a dir: %s", path)
-			break
-		}
-
-		f, err := os.Open(path)
-		if err != nil {
-			constor.error("Open failed on %s", path)
-			break
-		}
-		infos, _ := f.Readdir(0)
-		for i := range infos {
-			// workaround forhttps://code.google.com/p/go/issues/detail?id=5960
-			if infos[i] == nil {
-				continue
-			}
-			name := infos[i].Name()
-			if _, ok := entries[name]; ok {
-				// skip if the file was in upper layer
-				continue
-			}
-			d := DirEntry {
-				Name: name,
-				Mode: uint32(infos[i].Mode()),
-			}
-			if constor.isdeleted(Path.Join(path, name), infos[i].Sys().(*syscall.Stat_t)) {
-				d.Deleted = true
-			} else {
-				id, err := constor.getid(li, inode.id, name)
-				if err != nil {
-					constor.error("getid failed on %d %s %s", li, inode.id, name)
-					continue;
-				}
-				d.Ino = idtoino(id)
-			}
-			entries[name] = d
-		}
-		f.Close()
-	}
-	output := make([]DirEntry, 0, 500)
-
-	for _, d := range entries {
-		if d.Deleted {
-			continue
-		}
-		output = append(output, d)
-	}
-
-	if len(output) > 0 {
+	if !constor.dirempty(inode.id) {
 		constor.error("Directory not empty %s %s", parent.id, name)
 		return fuse.Status(syscall.ENOTEMPTY)
 	}
 
-	if inode.layer == 0 {
-		path := constor.getPath(0, inode.id)
-		if err := os.RemoveAll(path); err != nil {
-			constor.error("RemoveAll on %s : %s", path, err)
-			return fuse.ToStatus(err)
-		}
+	if err := constor.rmdirobject(inode); err != nil {
+		return fuse.ToStatus(err)
 	}
 	err = constor.copyup(parent)
 	if err != nil {
@@ -779,7 +789,6 @@ func (constor *Constor) Rmdir(header *fuse.InHeader, name string) (code fuse.Sta
 	if _, err := constor.getid(-1, parent.id, name); err == nil {
 		constor.setdeleted(entrypath)
 	}
-	inode.layer = -1
 	return fuse.OK
 }
 
@@ -789,6 +798,8 @@ func (constor *Constor) Symlink(header *fuse.InHeader, pointedTo string, linkNam
 		constor.error("inode == nil")
 		return fuse.ENOENT
 	}
+	inode.dirmu.Lock()
+	defer inode.dirmu.Unlock()
 	err := constor.copyup(inode)
 	if err != nil {
 		constor.error("copyup failed for %s - %s", inode.id, err)
@@ -840,64 +851,118 @@ func (constor *Constor) Rename(input *fuse.RenameIn, oldName string, newName str
 		constor.error("newParent == nil")
 		return fuse.ENOENT
 	}
+	if input.Flags&^(RENAME_NOREPLACE|RENAME_EXCHANGE) != 0 ||
+		input.Flags == (RENAME_NOREPLACE|RENAME_EXCHANGE) {
+		constor.error("unsupported flags %d", input.Flags)
+		return fuse.EINVAL
+	}
+	lockdirs(oldParent, newParent)
+	defer unlockdirs(oldParent, newParent)
 	if err := constor.copyup(newParent); err != nil {
 		constor.error("copyup failed for %s - %s", newParent.id, err)
 		return fuse.EIO
 	}
+	if err := constor.copyup(oldParent); err != nil {
+		constor.error("copyup failed for %s - %s", oldParent.id, err)
+		return fuse.EIO
+	}
 	newParentPath := constor.getPath(0, newParent.id)
 	newentrypath := Path.Join(newParentPath, newName)
-	constor.log("%s %s %s %s", oldParent.id, oldName, newParent.id, newName)
+	oldParentPath := constor.getPath(0, oldParent.id)
+	oldentrypath := Path.Join(oldParentPath, oldName)
+	constor.log("%s %s %s %s %d", oldParent.id, oldName, newParent.id, newName, input.Flags)
+
+	oldid, err := constor.getid(-1, oldParent.id, oldName)
+	if err != nil {
+		constor.error("getid error %s %s", oldParent.id, oldName)
+		return fuse.ToStatus(err)
+	}
+	oldinode := constor.inodemap.findInodeId(oldid)
+	if oldinode == nil {
+		constor.error("oldinode == nil for %s", oldid)
+		return fuse.ENOENT
+	}
+	path := constor.getPath(oldinode.getlayer(), oldid)
+	oldstat := syscall.Stat_t{}
+	if err := syscall.Lstat(path, &oldstat); err != nil {
+		constor.error("Lstat %s", path)
+		return fuse.ToStatus(err)
+	}
+	olddir := (oldstat.Mode & syscall.S_IFMT) == syscall.S_IFDIR
+
+	if input.Flags&RENAME_EXCHANGE != 0 {
+		iddel, err := constor.getid(-1, newParent.id, newName)
+		if err != nil {
+			constor.error("getid error %s %s", newParent.id, newName)
+			return fuse.ToStatus(err)
+		}
+		if inodedel = constor.inodemap.findInodeId(iddel); inodedel == nil {
+			constor.error("inodedel == nil for %s %s", newParent.id, newName)
+			return fuse.EIO
+		}
+		deltype, err := constor.idtype(iddel)
+		if err != nil {
+			constor.error("idtype %s : %s", iddel, err)
+			return fuse.ToStatus(err)
+		}
+		// both names stay in use, only the ids they point to are swapped
+		if err := constor.mkplaceholder(oldentrypath, iddel, deltype); err != nil {
+			constor.error("mkplaceholder %s : %s", oldentrypath, err)
+			return fuse.ToStatus(err)
+		}
+		if err := constor.mkplaceholder(newentrypath, oldid, oldstat.Mode); err != nil {
+			constor.error("mkplaceholder %s : %s", newentrypath, err)
+			return fuse.ToStatus(err)
+		}
+		oldinode.setparent(newParent.id)
+		inodedel.setparent(oldParent.id)
+		return fuse.OK
+	}
+
 	// remove any entry that existed in the newName's place
 	if iddel, err := constor.getid(-1, newParent.id, newName); err == nil {
+		if input.Flags&RENAME_NOREPLACE != 0 {
+			return fuse.Status(syscall.EEXIST)
+		}
+		if iddel == oldid {
+			// both names are links to the same object
+			return fuse.OK
+		}
 		if inodedel = constor.inodemap.findInodeId(iddel); inodedel != nil {
-			if inodedel.layer == 0 {
-				linkcnt, err := constor.declinkscnt(inodedel.id)
-				if err != nil {
-					constor.error("declinkscnt %s : %s", inodedel.id, err)
-					return fuse.ToStatus(err)
+			deltype, err := constor.idtype(iddel)
+			if err != nil {
+				constor.error("idtype %s : %s", iddel, err)
+				return fuse.ToStatus(err)
+			}
+			if deltype == syscall.S_IFDIR {
+				if !olddir {
+					return fuse.Status(syscall.EISDIR)
 				}
-				if linkcnt == 0 {
-					path := constor.getPath(0, iddel)
-					fi, err := os.Lstat(path)
-					if err != nil {
-						constor.error("Lstat failed on %s", path)
-						return fuse.ToStatus(err)
-					}
-					if fi.IsDir() {
-						// FIXME: take care of this situation
-						constor.error("path is a directory")
-						return fuse.Status(syscall.EEXIST)
-					}
-					if err := syscall.Unlink(path); err != nil {
-						constor.error("Unable to remove %s", path)
-						return fuse.ToStatus(err)
-					}
-					inodedel.layer = -1
+				if !constor.dirempty(iddel) {
+					constor.error("Directory not empty %s %s", newParent.id, newName)
+					return fuse.Status(syscall.ENOTEMPTY)
 				}
+				if err := constor.rmdirobject(inodedel); err != nil {
+					return fuse.ToStatus(err)
+				}
+			} else if olddir {
+				return fuse.Status(syscall.ENOTDIR)
+			} else if err := constor.unlinkobject(inodedel); err != nil {
+				return fuse.ToStatus(err)
 			}
 			stat := syscall.Stat_t{}
-			// FIXME do copyup and declinkscnt
 			if err := syscall.Lstat(newentrypath, &stat); err == nil {
-				fi, err := os.Lstat(newentrypath)
-				if err != nil {
-					constor.error("Lstat failed on %s", newentrypath)
-					return fuse.ToStatus(err)
-				}
-				if fi.IsDir() {
-					// FIXME: take care of this situation
-					constor.error("path is a directory")
-					return fuse.Status(syscall.EEXIST)
+				if (stat.Mode & syscall.S_IFMT) == syscall.S_IFDIR {
+					err = syscall.Rmdir(newentrypath)
+				} else {
+					err = syscall.Unlink(newentrypath)
 				}
-				if err := syscall.Unlink(newentrypath); err != nil {
-					constor.error("Unable to remove %s", newentrypath)
+				if err != nil {
+					constor.error("Unable to remove %s : %s", newentrypath, err)
 					return fuse.ToStatus(err)
 				}
 			}
-			// inodedel.parentPtr = input.Newdir
-			// inodedel.name = newName
 			sendEntryNotify = true
-			// constor.ms.DeleteNotify(input.Newdir, uint64(uintptr(unsafe.Pointer(inodedel))), newName)
-			// constor.ms.EntryNotify(input.Newdir, newName)
 		} else {
 			constor.error("inodedel == nil for %s %s", newParent.id, newName)
 			return fuse.EIO
@@ -910,27 +975,9 @@ func (constor *Constor) Rename(input *fuse.RenameIn, oldName string, newName str
 			return fuse.ToStatus(err)
 		}
 	}
-	oldid, err := constor.getid(-1, oldParent.id, oldName)
-	if err != nil {
-		constor.error("getid error %s %s", oldParent.id, oldName)
-		return fuse.ToStatus(err)
-	}
-	oldinode := constor.inodemap.findInodeId(oldid)
-	if oldinode == nil {
-		constor.error("oldinode == nil for %s", oldid)
-		return fuse.ENOENT
-	}
-	path := constor.getPath(oldinode.layer, oldid)
-	fi, err := os.Lstat(path)
-	if err != nil {
-		constor.error("Lstat %s", path)
-		return fuse.ToStatus(err)
-	}
-	oldParentPath := constor.getPath(0, oldParent.id)
-	oldentrypath := Path.Join(oldParentPath, oldName)
-	oldstat := syscall.Stat_t{}
-	if err := syscall.Lstat(oldentrypath, &oldstat); err == nil {
-		if fi.IsDir() {
+	stat := syscall.Stat_t{}
+	if err := syscall.Lstat(oldentrypath, &stat); err == nil {
+		if (stat.Mode & syscall.S_IFMT) == syscall.S_IFDIR {
 			if err := syscall.Rmdir(oldentrypath); err != nil {
 				constor.error("Rmdir %s : %s", oldentrypath, err)
 				return fuse.ToStatus(err)
@@ -945,32 +992,13 @@ func (constor *Constor) Rename(input *fuse.RenameIn, oldName string, newName str
 	if _, err := constor.getid(-1, oldParent.id, oldName); err == nil {
 		constor.setdeleted(oldentrypath)
 	}
-	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
-		err = os.Symlink("placeholder", newentrypath)
-		if err != nil {
-			constor.error("Symlink %s : %s", newentrypath, err)
-			return fuse.ToStatus(err)
-		}
-	} else if fi.Mode()&os.ModeDir == os.ModeDir {
-		err := os.Mkdir(newentrypath, fi.Mode())
-		if err != nil {
-			constor.error("Mkdir %s : %s", newentrypath, err)
-			return fuse.ToStatus(err)
-		}
-	} else {
-		fd, err := syscall.Creat(newentrypath, uint32(fi.Mode()))
-		if err != nil {
-			constor.error("create %s : %s", newentrypath, err)
-			return fuse.ToStatus(err)
-		}
-		syscall.Close(fd)
-	}
-	id := constor.setid(newentrypath, oldid)
-	if id == "" {
-		constor.error("setid %s : %s", newentrypath, err)
-		return fuse.EIO
+	if err := constor.mkplaceholder(newentrypath, oldid, oldstat.Mode); err != nil {
+		constor.error("mkplaceholder %s : %s", newentrypath, err)
+		return fuse.ToStatus(err)
 	}
-	if sendEntryNotify {
+	oldinode.setparent(newParent.id)
+	// there is no server when replaying a trace
+	if sendEntryNotify && constor.ms != nil {
 		go func() {
 			// FIXME: is this needed?
 			constor.ms.DeleteNotify(input.Newdir, uint64(uintptr(unsafe.Pointer(inodedel))), newName)
@@ -980,7 +1008,6 @@ func (constor *Constor) Rename(input *fuse.RenameIn, oldName string, newName str
 	return fuse.OK
 }
 
-
 func (constor *Constor) Link(input *fuse.LinkIn, name string, out *fuse.EntryOut) (code fuse.Status) {
 	inodeold := constor.inodemap.findInodePtr(input.Oldnodeid)
 	if inodeold == nil {
@@ -993,6 +1020,8 @@ func (constor *Constor) Link(input *fuse.LinkIn, name string, out *fuse.EntryOut
 		return fuse.ENOENT
 	}
 	constor.log("%s <- %s/%s", inodeold.id, parent.id, name)
+	parent.dirmu.Lock()
+	defer parent.dirmu.Unlock()
 	if err := constor.copyup(inodeold); err != nil {
 		constor.error("copyup failed for %s - %s", inodeold.id, err)
 		return fuse.ToStatus(err)
@@ -1019,7 +1048,7 @@ func (constor *Constor) Link(input *fuse.LinkIn, name string, out *fuse.EntryOut
 	}
 	id := constor.setid(entrypath, inodeold.id)
 	if id == "" {
-		constor.error("setid %s : %s", entrypath)
+		constor.error("setid failed on %s", entrypath)
 		return fuse.EIO
 	}
 	if err := constor.inclinkscnt(inodeold.id); err != nil {
@@ -1030,37 +1059,163 @@ func (constor *Constor) Link(input *fuse.LinkIn, name string, out *fuse.EntryOut
 }
 
 func (constor *Constor) GetXAttrSize(header *fuse.InHeader, attr string) (size int, code fuse.Status) {
-	return 0, fuse.ENOSYS
+	data, code := constor.GetXAttrData(header, attr)
+	return len(data), code
 }
 
 func (constor *Constor) GetXAttrData(header *fuse.InHeader, attr string) (data []byte, code fuse.Status) {
-	return nil, fuse.ENOSYS
+	inode := constor.inodemap.findInodePtr(header.NodeId)
+	if inode == nil {
+		constor.error("inode == nil")
+		return nil, fuse.ENOENT
+	}
+	if isinternalxattr(attr) {
+		return nil, fuse.ENODATA
+	}
+	li := inode.getlayer()
+	if li == -1 {
+		return nil, fuse.ENOENT
+	}
+	path := constor.getPath(li, inode.id)
+	data, err := Lgetxattr(path, attr)
+	if err != nil {
+		constor.error("Lgetxattr failed on %s %s : %s", path, attr, err)
+		return nil, fuse.ToStatus(err)
+	}
+	if data == nil {
+		return nil, fuse.ENODATA
+	}
+	return data, fuse.OK
 }
 
 func (constor *Constor) SetXAttr(input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
-	return fuse.ENOSYS
+	inode := constor.inodemap.findInodePtr(input.NodeId)
+	if inode == nil {
+		constor.error("inode == nil")
+		return fuse.ENOENT
+	}
+	constor.log("%s %s", inode.id, attr)
+	if isinternalxattr(attr) {
+		return fuse.EPERM
+	}
+	if inode.getlayer() == -1 {
+		return fuse.ENOENT
+	}
+	if err := constor.copyup(inode); err != nil {
+		constor.error("copyup failed for %s - %s", inode.id, err)
+		return fuse.ToStatus(err)
+	}
+	path := constor.getPath(0, inode.id)
+	if err := Lsetxattr(path, attr, data, int(input.Flags)); err != nil {
+		constor.error("Lsetxattr failed on %s %s : %s", path, attr, err)
+		return fuse.ToStatus(err)
+	}
+	return fuse.OK
 }
 
 func (constor *Constor) ListXAttr(header *fuse.InHeader) (data []byte, code fuse.Status) {
-	return nil, fuse.ENOSYS
+	inode := constor.inodemap.findInodePtr(header.NodeId)
+	if inode == nil {
+		constor.error("inode == nil")
+		return nil, fuse.ENOENT
+	}
+	li := inode.getlayer()
+	if li == -1 {
+		return nil, fuse.ENOENT
+	}
+	path := constor.getPath(li, inode.id)
+	attrs, err := Llistxattr(path)
+	if err != nil {
+		constor.error("Llistxattr failed on %s : %s", path, err)
+		return nil, fuse.ToStatus(err)
+	}
+	data = []byte{}
+	for _, attr := range attrs {
+		if isinternalxattr(attr) {
+			continue
+		}
+		data = append(data, attr...)
+		data = append(data, 0)
+	}
+	return data, fuse.OK
 }
 
 func (constor *Constor) RemoveXAttr(header *fuse.InHeader, attr string) fuse.Status {
-	if attr == "inodemap" {
-		fmt.Println(constor.inodemap)
+	inode := constor.inodemap.findInodePtr(header.NodeId)
+	if inode == nil {
+		constor.error("inode == nil")
+		return fuse.ENOENT
+	}
+	constor.log("%s %s", inode.id, attr)
+	if isinternalxattr(attr) {
+		return fuse.EPERM
+	}
+	li := inode.getlayer()
+	if li == -1 {
+		return fuse.ENOENT
+	}
+	// avoid a needless copyup when the attribute does not exist
+	path := constor.getPath(li, inode.id)
+	if data, err := Lgetxattr(path, attr); err == nil && data == nil {
+		return fuse.ENODATA
+	}
+	if err := constor.copyup(inode); err != nil {
+		constor.error("copyup failed for %s - %s", inode.id, err)
+		return fuse.ToStatus(err)
+	}
+	path = constor.getPath(0, inode.id)
+	if err := Lremovexattr(path, attr); err != nil {
+		constor.error("Lremovexattr failed on %s %s : %s", path, attr, err)
+		return fuse.ToStatus(err)
 	}
 	return fuse.OK
 }
 
 func (constor *Constor) Access(input *fuse.AccessIn) (code fuse.Status) {
-	constor.error("%d", input.NodeId)
-	return fuse.ENOSYS
-	// FIXME: oops fix this
-	// path, err := constor.getPath(input.NodeId)
-	// if err != nil {
-	// 	return fuse.ToStatus(err)
-	// }
-	// return fuse.ToStatus(syscall.Access(path, input.Mask))
+	var stat syscall.Stat_t
+	inode := constor.inodemap.findInodePtr(input.NodeId)
+	if inode == nil {
+		constor.error("inode == nil")
+		return fuse.ENOENT
+	}
+	constor.log("%s %o", inode.id, input.Mask)
+	li := inode.getlayer()
+	if li == -1 {
+		return fuse.ENOENT
+	}
+	if err := constor.Lstat(li, inode.id, &stat); err != nil {
+		constor.error("Lstat failed on %s : %s", inode.id, err)
+		return fuse.ToStatus(err)
+	}
+	mask := input.Mask & (R_OK | W_OK | X_OK)
+	if mask == 0 {
+		// F_OK
+		return fuse.OK
+	}
+	if mask&W_OK != 0 && constor.readonly {
+		return fuse.Status(syscall.EROFS)
+	}
+	uid := input.Uid
+	if uid == 0 {
+		// root can read and write anything but needs at least one
+		// execute bit for non directories
+		if mask&X_OK == 0 || (stat.Mode&syscall.S_IFMT) == syscall.S_IFDIR || stat.Mode&0111 != 0 {
+			return fuse.OK
+		}
+		return fuse.EACCES
+	}
+	var perm uint32
+	if uid == stat.Uid {
+		perm = (stat.Mode >> 6) & 07
+	} else if constor.ingroup(input.Pid, input.Gid, stat.Gid) {
+		perm = (stat.Mode >> 3) & 07
+	} else {
+		perm = stat.Mode & 07
+	}
+	if perm&mask != mask {
+		return fuse.EACCES
+	}
+	return fuse.OK
 }
 
 func (constor *Constor) Create(input *fuse.CreateIn, name string, out *fuse.CreateOut) (code fuse.Status) {
@@ -1071,6 +1226,8 @@ func (constor *Constor) Create(input *fuse.CreateIn, name string, out *fuse.Crea
 		constor.error("inode == nil")
 		return fuse.ENOENT
 	}
+	inode.dirmu.Lock()
+	defer inode.dirmu.Unlock()
 	err := constor.copyup(inode)
 	if err != nil {
 		constor.error("copyup failed for %s - %s", inode.id, err)
@@ -1141,9 +1298,30 @@ func (constor *Constor) Open(input *fuse.OpenIn, out *fuse.OpenOut) (status fuse
 	if inode == nil {
 		return fuse.ENOENT
 	}
-	path :=  constor.getPath(inode.layer, inode.id)
+	li := inode.getlayer()
+	if li == -1 {
+		return fuse.ENOENT
+	}
+	flags := int(input.Flags)
+	// Opens for writing stay on the lower layer until the first Write or
+	// SetAttr copies them up. The kernel drops O_TRUNC unless atomic_o_trunc
+	// is negotiated and sends a SETATTR of size 0 after the open instead,
+	// that one copies up without the data.
+	if li != 0 && flags&syscall.O_TRUNC != 0 {
+		err := constor.copyupempty(inode)
+		if err != nil {
+			constor.error("copyup failed for %s - %s", inode.id, err)
+			return fuse.ToStatus(err)
+		}
+		li = inode.getlayer()
+	}
+	if li != 0 {
+		// lower layers are shared, never write to them
+		flags = syscall.O_RDONLY | flags&^(syscall.O_ACCMODE|syscall.O_CREAT|syscall.O_EXCL|syscall.O_TRUNC|syscall.O_APPEND)
+	}
+	path :=  constor.getPath(li, inode.id)
 	constor.log("%s %d", path, input.Flags)
-	fd, err := syscall.Open(path, int(input.Flags), 0)
+	fd, err := syscall.Open(path, flags, 0)
 	if err != nil {
 		constor.error("open failed %s : %s", path, err)
 		return fuse.ToStatus(err)
@@ -1151,7 +1329,7 @@ func (constor *Constor) Open(input *fuse.OpenIn, out *fuse.OpenOut) (status fuse
 	F := new(FD)
 	F.fd = fd
 	F.flags = int(input.Flags)
-	F.layer = inode.layer
+	F.layer = li
 	F.id = inode.id
 	F.pid = input.Pid
 	constor.putfd(F)
@@ -1183,20 +1361,14 @@ func (constor *Constor) Read(input *fuse.ReadIn, buf []byte) (fuse.ReadResult, f
 		return nil, fuse.EIO
 	}
 
-	if (F.layer != inode.layer) && (inode.layer == 0) {
-		syscall.Close(F.fd)
-		path := constor.getPath(0, inode.id)
-		fd, err := syscall.Open(path, F.flags, 0)
-		if err != nil {
-			constor.error("open failed %s : %s", path, err)
-			return nil, fuse.ToStatus(err)
-		}
-		F.fd = fd
-		F.layer = 0
-		constor.log("reset fd for %s", path)
+	if err := constor.fdswitch(F, inode); err != nil {
+		return nil, fuse.ToStatus(err)
 	}
-	if (F.layer != inode.layer) && (inode.layer >= 0) {
-		constor.error("%s : %d", F.id, inode.layer)
+	F.RLock()
+	defer F.RUnlock()
+	li := inode.getlayer()
+	if (F.layer != li) && (li >= 0) {
+		constor.error("%s : %d", F.id, li)
 		return nil, fuse.EBADF
 	}
 	fd := F.fd
@@ -1215,9 +1387,16 @@ func (constor *Constor) Release(input *fuse.ReleaseIn) {
 	if F == nil {
 		return
 	}
-	fd := F.fd
 	constor.deletefd(ptr)
-	syscall.Close(fd)
+	// syncfds may still hold it
+	F.Lock()
+	syscall.Close(F.fd)
+	F.fd = -1
+	F.Unlock()
+	if constor.inodemap.findInodeId(F.id) == nil {
+		// forgotten while open
+		constor.reclaimorphan(F.id)
+	}
 }
 
 func (constor *Constor) Write(input *fuse.WriteIn, data []byte) (written uint32, code fuse.Status) {
@@ -1239,35 +1418,35 @@ func (constor *Constor) Write(input *fuse.WriteIn, data []byte) (written uint32,
 	if inode == nil {
 		return 0, fuse.ENOENT
 	}
-	if F.layer != 0 && inode.layer != 0 {
-		err := constor.copyup(inode)
-		if err != nil {
-			constor.error("%s", err)
+	F.RLock()
+	flayer := F.layer
+	F.RUnlock()
+	if flayer != 0 && F.flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		// nothing to copy for a write that fails anyway
+		return 0, fuse.EBADF
+	}
+	if flayer != 0 && inode.getlayer() == -1 {
+		if err := constor.orphanup(inode); err != nil {
+			constor.error("orphanup failed for %s - %s", inode.id, err)
 			return 0, fuse.ToStatus(err)
 		}
-		path := constor.getPath(0, inode.id)
-		syscall.Close(F.fd)
-		fd, err := syscall.Open(path, F.flags, 0)
+	} else if flayer != 0 {
+		err := constor.copyup(inode)
 		if err != nil {
 			constor.error("%s", err)
 			return 0, fuse.ToStatus(err)
 		}
-		F.fd = fd
-		F.layer = 0
-		constor.log("reset fd for %s", path)
-	} else if F.layer != 0 && inode.layer == 0 {
-		syscall.Close(F.fd)
-		path := constor.getPath(0, inode.id)
-		fd, err := syscall.Open(path, F.flags, 0)
-		if err != nil {
-			constor.error("%s", err)
+		if err := constor.fdswitch(F, inode); err != nil {
 			return 0, fuse.ToStatus(err)
 		}
-		F.fd = fd
-		F.layer = 0
-		constor.log("reset fd for %s", path)
 	}
 
+	F.RLock()
+	defer F.RUnlock()
+	if F.layer != 0 {
+		constor.error("%s : write to layer %d", F.id, F.layer)
+		return 0, fuse.EIO
+	}
 	fd := F.fd
 	n, err := syscall.Pwrite(fd, wdata, int64(offset))
 	return uint32(n), fuse.ToStatus(err)
@@ -1284,20 +1463,23 @@ func (constor *Constor) Fsync(input *fuse.FsyncIn) (code fuse.Status) {
 }
 
 func (constor *Constor) ReadDirPlus(input *fuse.ReadIn, fuseout *fuse.DirEntryList) fuse.Status {
-	return fuse.ENOSYS
-	constor.log("")
-	constor.log("%d", input.Offset)
 	ptr := uintptr(input.Fh)
 	offset := input.Offset
-	entryOut := fuse.EntryOut{}
 	out := (*DirEntryList)(unsafe.Pointer(fuseout))
 
 	F := constor.getfd(ptr)
+	if F == nil {
+		constor.error("F == nil")
+		return fuse.EIO
+	}
+	constor.log("%s %d", F.id, offset)
 	stream := F.stream
 	if stream == nil {
+		constor.error("stream == nil for %s", F.id)
 		return fuse.EIO
 	}
 	if offset > uint64(len(stream)) {
+		constor.error("offset > %d for %s", len(stream), F.id)
 		return fuse.EINVAL
 	}
 	todo := F.stream[offset:]
@@ -1305,19 +1487,64 @@ func (constor *Constor) ReadDirPlus(input *fuse.ReadIn, fuseout *fuse.DirEntryLi
 		if e.Name == "" {
 			continue
 		}
-		// attr := (*fuse.Attr)(&entryOut.Attr)
-		// attr.FromStat(&e.Stat)
-		// entryOut.NodeId = attr.Ino
-		// entryOut.Ino = attr.Ino
-		constor.Lookup((*fuse.InHeader)(unsafe.Pointer(input)), e.Name, &entryOut)
+		entryOut := fuse.EntryOut{}
+		if e.Name == "." || e.Name == ".." {
+			// the kernel ignores the lookup data for "." and ".." and
+			// does not account a lookup for them, a zero NodeId says so
+			ok, _ := out.AddDirLookupEntry(e, &entryOut)
+			if !ok {
+				break
+			}
+			continue
+		}
+		inode := constor.direntinode(F.id, e.Id, &entryOut)
+		if inode == nil {
+			// let the kernel do a regular LOOKUP for this entry
+			entryOut = fuse.EntryOut{}
+		}
 		ok, _ := out.AddDirLookupEntry(e, &entryOut)
 		if !ok {
+			// only entries with a NodeId that reached the kernel count
+			// as a lookup
+			if inode != nil {
+				inode.forget(1)
+			}
 			break
 		}
 	}
 	return fuse.OK
 }
 
+// fills out for the object id and takes a lookup reference on the
+// returned inode
+func (constor *Constor) direntinode(parentid string, id string, out *fuse.EntryOut) *Inode {
+	var stat syscall.Stat_t
+	if id == "" {
+		return nil
+	}
+	li := -1
+	if inode := constor.inodemap.findInodeId(id); inode != nil {
+		li = inode.getlayer()
+	} else {
+		li = constor.getLayer(id)
+	}
+	if li == -1 {
+		return nil
+	}
+	if err := constor.Lstat(li, id, &stat); err != nil {
+		constor.error("Unable to Lstat %s : %s", id, err)
+		return nil
+	}
+	inode := constor.inodemap.lookupInode(id, li, parentid)
+	attr := (*fuse.Attr)(&out.Attr)
+	attr.FromStat(&stat)
+	out.NodeId = uint64(uintptr(unsafe.Pointer(inode)))
+	out.Ino = attr.Ino
+	out.SetEntryTimeout(constor.entrytimeout)
+	out.SetAttrTimeout(constor.attrtimeout)
+	return inode
+}
+
 func (constor *Constor) FsyncDir(input *fuse.FsyncIn) (code fuse.Status) {
 	return fuse.OK
 }
@@ -1337,65 +1564,186 @@ func (constor *Constor) Fallocate(in *fuse.FallocateIn) (code fuse.Status) {
 //     return string(b)
 // }
 
-func main() {
-	// godaemon.MakeDaemon(&godaemon.DaemonAttr{})
-	// log.SetFlags(log.Lshortfile)
-	layers := os.Args[1]
-	mountPoint := os.Args[2]
-	// defer profile.Start(profile.CPUProfile).Stop()
-	// F, err := os.OpenFile("/tmp/constor", os.O_APPEND|os.O_WRONLY, 0)
-	// F.Write([]byte("START\n"))
-	// F.Write([]byte(layers))
-	// F.Write([]byte(" "))
-	// F.Write([]byte(mountPoint))
-	// F.Write([]byte("\n"))
-
-	if len(os.Args) != 3 {
-		fmt.Println("Usage: constor /layer0:/layer1:....:/layerN /mnt/point")
-		os.Exit(1)
-	}
-
-	pid := os.Getpid()
-	pidstr := strconv.Itoa(pid)
-	logf, err := os.Create("/tmp/constor.log." + pidstr)
-	// logf, err := os.OpenFile("/dev/null", os.O_RDWR, 0)
-	logfd := logf.Fd()
-	syscall.Dup2(int(logfd), 1)
-	syscall.Dup2(int(logfd), 2)
-
-
+func NewConstor(opts *Options, logf *os.File) *Constor {
 	constor := new(Constor)
 	constor.inodemap = NewInodemap(constor)
 	constor.fdmap = make(map[uintptr]*FD)
+	constor.fdids = make(map[string][]*FD)
+	constor.fdpids = make(map[fdkey][]*FD)
+	constor.copyupcalls = make(map[string]*copyupcall)
+	constor.metrics = NewMetrics()
 	constor.logf = logf
-	constor.layers = strings.Split(layers, ":")
+	constor.logpath = opts.logfile
+	constor.loglevel = opts.loglevel
+	constor.logjson = opts.logjson
+	constor.setlogops(opts.logops)
+	constor.layers = opts.layers
+	constor.whiteout = opts.whiteout
+	constor.xattrallow = opts.xattrallow
+	constor.xattrdeny = opts.xattrdeny
+	constor.entrytimeout = opts.entrytimeout
+	constor.attrtimeout = opts.attrtimeout
+	constor.readonly = opts.readonly
+	return constor
+}
 
-	numlayers := len(constor.layers)
-	if len(constor.layers[numlayers-1]) == 0 {
-		numlayers--
-		constor.layers = constor.layers[:numlayers]
+// creates the root directory in layer0 and cleans up after a crash
+func (constor *Constor) preparelayers() error {
+	if constor.readonly {
+		return nil
 	}
-
-	err = os.MkdirAll(Path.Join(constor.layers[0], ROOTID), 0777)
+	err := os.MkdirAll(Path.Join(constor.layers[0], ROOTID), 0777)
 	if err != nil && err != os.ErrExist {
-		constor.error("Unable to mkdir %s", ROOTID)
+		return fmt.Errorf("unable to mkdir %s : %s", ROOTID, err)
+	}
+	if err := constor.cleantmp(); err != nil {
+		constor.error("Unable to clean stale copyups and orphans : %s", err)
+	}
+	return nil
+}
+
+func main() {
+	// log.SetFlags(log.Lshortfile)
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(ctlmain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replaymain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(fsckmain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(importmain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migratemain(os.Args[2:]))
+	}
+	args := os.Args[1:]
+	fake := false
+	if ismounthelper() {
+		var err error
+		args, fake, err = mounthelperargs(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mount.constor: %s\n\n%s", err, USAGE)
+			os.Exit(1)
+		}
+	}
+	opts, err := parseoptions(args)
+	if err == flag.ErrHelp {
+		fmt.Print(USAGE)
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "constor: %s\n\n%s", err, USAGE)
 		os.Exit(1)
 	}
+	if fake {
+		os.Exit(0)
+	}
+	if ismounthelper() && !opts.foreground {
+		opts.daemon = true
+	}
+	var ready *os.File
+	if opts.daemon {
+		ready = daemonize()
+	}
+	// defer profile.Start(profile.CPUProfile).Stop()
 
-	constor.log("%s %s", layers, mountPoint)
+	logf, err := openlog(opts.logfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "constor: unable to open log %s : %s\n", opts.logfile, err)
+		os.Exit(1)
+	}
 
+	constor := NewConstor(opts, logf)
+	if opts.trace != "" {
+		tracer, err := NewTracer(opts.trace)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "constor: unable to open trace %s : %s\n", opts.trace, err)
+			os.Exit(1)
+		}
+		constor.tracer = tracer
+		defer tracer.close()
+	}
+	if err := constor.preparelayers(); err != nil {
+		fmt.Fprintf(os.Stderr, "constor: %s\n", err)
+		os.Exit(1)
+	}
+	if opts.sweep != "" {
+		report, err := constor.sweep(opts.sweep)
+		if err != nil {
+			constor.error("sweep failed : %s", err)
+		} else {
+			constor.info("sweep: %d objects, %d entries", len(report.Objects), len(report.Entries))
+		}
+	}
+
+	constor.log("%s %s", strings.Join(opts.layers, ":"), opts.mountpoint)
+
+	options := []string{
+		"fsname=" + constor.layers[0],
+		"user_id=" + strconv.Itoa(os.Getuid()),
+		"group_id=" + strconv.Itoa(os.Getgid()),
+	}
+	if opts.nonempty {
+		options = append(options, "nonempty")
+	}
+	if opts.defaultperms {
+		options = append(options, "default_permissions")
+	}
+	if opts.readonly {
+		options = append(options, "ro")
+	}
+	options = append(options, opts.mountopts...)
 	mOpts := &fuse.MountOptions{
 		Name:    "constor",
 		// SingleThreaded: true,
-		// Options: []string{"nonempty", "allow_other", "default_permissions", "user_id=0", "group_id=0", "fsname=" + constor.layers[0], "kernel_cache", "entry_timeout=100.0", "attr_timeout=100.0"},
-		Options: []string{"nonempty", "allow_other", "default_permissions", "user_id=0", "group_id=0", "fsname=" + constor.layers[0]},
+		AllowOther: opts.allowother,
+		Debug:      opts.debug,
+		Options:    options,
 	}
 	_ = syscall.Umask(000)
-	state, err := fuse.NewServer(constor, mountPoint, mOpts)
+	state, err := fuse.NewServer(&Instrumented{constor}, opts.mountpoint, mOpts)
 	if err != nil {
-		// fmt.Printf("Mount fail: %v\n", err)
+		fmt.Fprintf(os.Stderr, "constor: mount failed : %s\n", err)
 		os.Exit(1)
 	}
 	constor.ms = state
+	if opts.pidfile != "" {
+		if err := writepidfile(opts.pidfile); err != nil {
+			fmt.Fprintf(os.Stderr, "constor: unable to write pid file %s : %s\n", opts.pidfile, err)
+			state.Unmount()
+			os.Exit(1)
+		}
+		defer os.Remove(opts.pidfile)
+	}
+	if opts.ctl != "" {
+		if err := constor.servectl(opts.ctl); err != nil {
+			fmt.Fprintf(os.Stderr, "constor: unable to serve %s : %s\n", opts.ctl, err)
+			state.Unmount()
+			os.Exit(1)
+		}
+		defer constor.ctl.Close()
+	}
+	if opts.metrics != "" {
+		if err := constor.servemetrics(opts.metrics); err != nil {
+			fmt.Fprintf(os.Stderr, "constor: unable to serve metrics on %s : %s\n", opts.metrics, err)
+			state.Unmount()
+			os.Exit(1)
+		}
+	}
+	constor.handlesignals()
+	constor.handlelogsignals(opts.loglevel)
+	notifyready(ready)
+	if err := sdnotify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid())); err != nil {
+		constor.error("sd_notify failed : %s", err)
+	}
+
+	if opts.daemon && logf != os.Stderr {
+		// nobody reads the daemon's stderr, keep panics in the log
+		syscall.Dup2(int(logf.Fd()), 2)
+	}
 	state.Serve()
+	sdnotify("STOPPING=1")
 }
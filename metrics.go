@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// upper bounds in seconds of the operation latency histogram buckets
+var LATENCYBUCKETS = []float64{
+	0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5,
+}
+
+type opmetrics struct {
+	calls   uint64
+	errors  uint64
+	sum     float64
+	buckets []uint64
+}
+
+type copyupmetrics struct {
+	count uint64
+	bytes uint64
+}
+
+// Metrics are the counters exported in the Prometheus text format. All
+// methods are no-ops on a nil *Metrics.
+type Metrics struct {
+	sync.Mutex
+	ops       map[string]*opmetrics
+	copyups   map[string]*copyupmetrics
+	layerhits map[int]uint64
+}
+
+func NewMetrics() *Metrics {
+	metrics := new(Metrics)
+	metrics.ops = make(map[string]*opmetrics)
+	metrics.copyups = make(map[string]*copyupmetrics)
+	metrics.layerhits = make(map[int]uint64)
+	return metrics
+}
+
+func (metrics *Metrics) observe(op string, elapsed time.Duration, code fuse.Status) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	m, ok := metrics.ops[op]
+	if !ok {
+		m = &opmetrics{buckets: make([]uint64, len(LATENCYBUCKETS))}
+		metrics.ops[op] = m
+	}
+	m.calls++
+	if !code.Ok() {
+		m.errors++
+	}
+	secs := elapsed.Seconds()
+	m.sum += secs
+	for i, bound := range LATENCYBUCKETS {
+		if secs <= bound {
+			m.buckets[i]++
+			break
+		}
+	}
+}
+
+func (metrics *Metrics) copyup(strategy string, bytes int64) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	m, ok := metrics.copyups[strategy]
+	if !ok {
+		m = new(copyupmetrics)
+		metrics.copyups[strategy] = m
+	}
+	m.count++
+	m.bytes += uint64(bytes)
+}
+
+// the number of copyups per strategy, also read by ctl /copyups
+func (metrics *Metrics) copyupcounts() map[string]uint64 {
+	counts := map[string]uint64{}
+	if metrics == nil {
+		return counts
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	for strategy, m := range metrics.copyups {
+		counts[strategy] = m.count
+	}
+	return counts
+}
+
+func (metrics *Metrics) layerhit(li int) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.layerhits[li]++
+}
+
+func formatfloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedkeys(m map[string]bool) []string {
+	keys := []string{}
+	for k, _ := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writes all metrics in the Prometheus text exposition format
+func (constor *Constor) writemetrics(w io.Writer) {
+	files := 0
+	dirs := 0
+	constor.Lock()
+	for _, F := range constor.fdmap {
+		if F.stream != nil {
+			dirs++
+		} else {
+			files++
+		}
+	}
+	inodes := len(constor.inodemap.ptrmap)
+	constor.Unlock()
+
+	metrics := constor.metrics
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	ops := map[string]bool{}
+	for op, _ := range metrics.ops {
+		ops[op] = true
+	}
+	fmt.Fprintf(w, "# HELP constor_op_requests_total FUSE requests handled per operation.\n")
+	fmt.Fprintf(w, "# TYPE constor_op_requests_total counter\n")
+	for _, op := range sortedkeys(ops) {
+		fmt.Fprintf(w, "constor_op_requests_total{op=%q} %d\n", op, metrics.ops[op].calls)
+	}
+	fmt.Fprintf(w, "# HELP constor_op_errors_total FUSE requests that returned an error per operation.\n")
+	fmt.Fprintf(w, "# TYPE constor_op_errors_total counter\n")
+	for _, op := range sortedkeys(ops) {
+		fmt.Fprintf(w, "constor_op_errors_total{op=%q} %d\n", op, metrics.ops[op].errors)
+	}
+	fmt.Fprintf(w, "# HELP constor_op_duration_seconds Latency of FUSE requests per operation.\n")
+	fmt.Fprintf(w, "# TYPE constor_op_duration_seconds histogram\n")
+	for _, op := range sortedkeys(ops) {
+		m := metrics.ops[op]
+		var cumulative uint64
+		for i, bound := range LATENCYBUCKETS {
+			cumulative += m.buckets[i]
+			fmt.Fprintf(w, "constor_op_duration_seconds_bucket{op=%q,le=%q} %d\n", op, formatfloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "constor_op_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, m.calls)
+		fmt.Fprintf(w, "constor_op_duration_seconds_sum{op=%q} %s\n", op, formatfloat(m.sum))
+		fmt.Fprintf(w, "constor_op_duration_seconds_count{op=%q} %d\n", op, m.calls)
+	}
+
+	strategies := map[string]bool{}
+	for strategy, _ := range metrics.copyups {
+		strategies[strategy] = true
+	}
+	fmt.Fprintf(w, "# HELP constor_copyups_total Objects copied up to layer0 per copy strategy.\n")
+	fmt.Fprintf(w, "# TYPE constor_copyups_total counter\n")
+	for _, strategy := range sortedkeys(strategies) {
+		fmt.Fprintf(w, "constor_copyups_total{strategy=%q} %d\n", strategy, metrics.copyups[strategy].count)
+	}
+	fmt.Fprintf(w, "# HELP constor_copyup_bytes_total Bytes of file data written to layer0 by copyups per copy strategy, reflinked data and holes are not counted.\n")
+	fmt.Fprintf(w, "# TYPE constor_copyup_bytes_total counter\n")
+	for _, strategy := range sortedkeys(strategies) {
+		fmt.Fprintf(w, "constor_copyup_bytes_total{strategy=%q} %d\n", strategy, metrics.copyups[strategy].bytes)
+	}
+
+	layers := []int{}
+	for li, _ := range metrics.layerhits {
+		layers = append(layers, li)
+	}
+	sort.Ints(layers)
+	fmt.Fprintf(w, "# HELP constor_layer_hits_total Objects and entries resolved per layer.\n")
+	fmt.Fprintf(w, "# TYPE constor_layer_hits_total counter\n")
+	for _, li := range layers {
+		fmt.Fprintf(w, "constor_layer_hits_total{layer=\"%d\"} %d\n", li, metrics.layerhits[li])
+	}
+
+	fmt.Fprintf(w, "# HELP constor_open_fds Open files and directories.\n")
+	fmt.Fprintf(w, "# TYPE constor_open_fds gauge\n")
+	fmt.Fprintf(w, "constor_open_fds{type=\"file\"} %d\n", files)
+	fmt.Fprintf(w, "constor_open_fds{type=\"dir\"} %d\n", dirs)
+	fmt.Fprintf(w, "# HELP constor_inodes Inodes known to the kernel.\n")
+	fmt.Fprintf(w, "# TYPE constor_inodes gauge\n")
+	fmt.Fprintf(w, "constor_inodes %d\n", inodes)
+}
+
+func (constor *Constor) metricshandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	constor.writemetrics(w)
+}
+
+// serves /metrics on the local tcp address addr, e.g. 127.0.0.1:9273
+func (constor *Constor) servemetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", constor.metricshandler)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			constor.error("metrics listener closed : %s", err)
+		}
+	}()
+	return nil
+}
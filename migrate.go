@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const MIGRATEUSAGE = `Usage: constor migrate /layer0:/layer1:....:/layerN
+
+Tags the legacy whiteouts of every layer given with
+trusted.constor.deleted, so that they are still whiteouts once the stack
+is mounted with -o whiteout=strict. Lower layers that once were layer0
+hold whiteouts as well, run it once on the whole stack while it is not
+mounted. 0:0 char devices that carry an id are entries of real devices and
+are left alone.
+`
+
+func migratemain(args []string) int {
+	flags := flag.NewFlagSet("constor migrate", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Print(MIGRATEUSAGE)
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "constor migrate: %s\n\n%s", err, MIGRATEUSAGE)
+		return 1
+	}
+	args = flags.Args()
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, MIGRATEUSAGE)
+		return 1
+	}
+	opts := defaultoptions()
+	opts.logfile = "-"
+	opts.whiteout = WHITEOUT_STRICT
+	opts.layers = splitlist(args[0])
+	if err := opts.validatelayers(); err != nil {
+		fmt.Fprintf(os.Stderr, "constor migrate: %s\n", err)
+		return 1
+	}
+
+	constor := NewConstor(opts, os.Stderr)
+	status := 0
+	for li, layer := range constor.layers {
+		count, err := constor.migratewhiteouts(li)
+		fmt.Printf("%s: %d whiteouts tagged\n", layer, count)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "constor migrate: %s : %s\n", layer, err)
+			status = 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"os"
+	Path "path"
+	"strings"
+)
+
+// mount(8) runs "mount.constor source target [-sfnv] [-o options]" for
+// filesystems of type constor, so constor can be used from fstab with
+//
+//	/layer0:/layer1  /mnt/point  constor  entry_timeout=10  0 0
+//
+// or with overlay like options
+//
+//	constor  /mnt/point  constor  upperdir=/layer0,lowerdir=/layer1:/layer2  0 0
+
+// options meant for mount(8) and systemd, not for the filesystem
+var mountignored = []string{
+	"defaults", "auto", "noauto", "nofail", "_netdev",
+	"user", "users", "nouser", "owner", "group",
+}
+
+func ismounthelper() bool {
+	return Path.Base(os.Args[0]) == "mount.constor"
+}
+
+func mountignoredopt(key string) bool {
+	if strings.HasPrefix(key, "x-") || key == "comment" {
+		return true
+	}
+	for _, opt := range mountignored {
+		if key == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// translates the mount(8) calling convention into constor arguments.
+// fake is set for "mount -f", which must not mount anything.
+func mounthelperargs(args []string) (cargs []string, fake bool, err error) {
+	positional := []string{}
+	opts := []string{}
+	upper := ""
+	lower := []string{}
+	haslayers := false
+	addopts := func(list string) {
+		for _, opt := range strings.Split(list, ",") {
+			key := opt
+			val := ""
+			if i := strings.Index(opt, "="); i >= 0 {
+				key = opt[:i]
+				val = opt[i+1:]
+			}
+			switch {
+			case opt == "":
+			case key == "upperdir":
+				upper = val
+			case key == "lowerdir":
+				lower = splitlist(val)
+			case key == "workdir":
+				// copyups are staged in layer0 itself
+			case mountignoredopt(key):
+			default:
+				if key == "layers" {
+					haslayers = true
+				}
+				opts = append(opts, opt)
+			}
+		}
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-o":
+			if i+1 >= len(args) {
+				return nil, false, errors.New("-o needs a value")
+			}
+			i++
+			addopts(args[i])
+		case strings.HasPrefix(arg, "-o"):
+			addopts(arg[2:])
+		case arg == "-f":
+			fake = true
+		case arg == "-s" || arg == "-n" || arg == "-v":
+			// sloppy, no mtab and verbose are of no use to constor
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, false, errors.New("expected a source and a target")
+	}
+	source := positional[0]
+	target := positional[1]
+	if upper != "" || len(lower) > 0 {
+		if haslayers {
+			return nil, false, errors.New("layers= can not be mixed with upperdir= or lowerdir=")
+		}
+		layers := lower
+		if upper != "" {
+			layers = append([]string{upper}, lower...)
+		} else {
+			// like overlayfs, no upperdir means a read-only mount
+			opts = append(opts, "ro")
+		}
+		opts = append(opts, "layers="+strings.Join(layers, ":"))
+		haslayers = true
+	}
+	if len(opts) > 0 {
+		cargs = append(cargs, "-o", strings.Join(opts, ","))
+	}
+	if !haslayers {
+		cargs = append(cargs, source)
+	}
+	cargs = append(cargs, target)
+	return cargs, fake, nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const USAGE = `Usage: constor [options] /layer0:/layer1:....:/layerN /mnt/point
+       constor [options] -o layers=/layer0:/layer1:....:/layerN /mnt/point
+       constor ctl SOCKET COMMAND [ARG]
+       constor replay [-v] [-n COUNT] [-o opt[,opt...]] TRACE /layer0:...:/layerN
+       constor fsck [-r] [-remove] [-o opt[,opt...]] /layer0:...:/layerN
+       constor import [-o opt[,opt...]] SRCDIR LAYERDIR
+       constor migrate /layer0:...:/layerN
+
+layer0 is the topmost layer which is r/w. Rest of the layers are r/o.
+
+Options:
+  -o opt[,opt...]          mount options, may be repeated
+  -d                       same as -o debug
+  -r                       same as -o ro
+  -h                       print this help
+
+Mount options:
+  layers=/l0:/l1:...       the layer stack, instead of the first argument
+  log=PATH                 log destination, "-" for stderr
+                           (default /tmp/constor.log.<pid>)
+  loglevel=LEVEL           error, warn, info, debug or trace (default error)
+  logformat=text|json      log line format (default text)
+  logops=OP:OP...          only log these operations below error level,
+                           e.g. Lookup:Rename:copyup
+  entry_timeout=SECS       kernel entry cache timeout (default 1000)
+  attr_timeout=SECS        kernel attribute cache timeout (default 1000)
+  allow_other              let other users access the mount (default)
+  noallow_other            only the mounting user can access the mount
+  default_permissions      let the kernel check permissions (default)
+  nodefault_permissions    check permissions in constor
+  nonempty                 allow mounting over a non empty dir (default)
+  ro                       mount read-only
+  rw                       mount read-write (default)
+  debug                    log every operation and debug the FUSE protocol
+  daemon                   run in the background once mounted
+  foreground               stay in the foreground, even as mount.constor
+  pidfile=PATH             write the pid of the serving process to PATH
+  ctl=PATH                 serve the control API on the unix socket PATH,
+                           see "constor ctl"
+  metrics=ADDR             serve Prometheus metrics on http://ADDR/metrics,
+                           e.g. 127.0.0.1:9273, also served on the ctl socket
+  trace=PATH               record every operation to PATH, see "constor replay"
+  sweep=quarantine|remove  on mount, move the objects of layer0 no entry
+                           refers to into .constor.lost or remove them, and
+                           drop the entries whose object is missing
+  whiteout=legacy|strict   whiteout format (default legacy), run
+                           "constor migrate" on all layers before
+                           switching a stack to strict
+  xattr_allow=NS:NS...     xattr prefixes kept on copyup (default all)
+  xattr_deny=NS:NS...      xattr prefixes dropped on copyup
+
+The generic mount flags nosuid, nodev, noexec, noatime, ... are passed
+on to the kernel.
+
+Installed or linked as mount.constor, it accepts the mount(8) calling
+convention "mount.constor source target [-sfnv] [-o options]" where the
+source is the layer stack, or the layers are given with the overlay
+options upperdir= and lowerdir=. It then runs in the background.
+
+SIGUSR1 and SIGUSR2 raise and lower the log level at runtime, SIGHUP
+reopens the log file and resets the log level.
+
+SIGTERM and SIGINT unmount the filesystem. Readiness is reported to
+systemd when NOTIFY_SOCKET is set.
+`
+
+type Options struct {
+	layers       []string
+	mountpoint   string
+	logfile      string
+	entrytimeout time.Duration
+	attrtimeout  time.Duration
+	allowother   bool
+	defaultperms bool
+	nonempty     bool
+	readonly     bool
+	debug        bool
+	loglevel     int32
+	logjson      bool
+	logops       []string
+	whiteout     string
+	xattrallow   []string
+	xattrdeny    []string
+	// generic mount flags passed on to the kernel as is
+	mountopts  []string
+	daemon     bool
+	foreground bool
+	pidfile    string
+	ctl        string
+	metrics    string
+	trace      string
+	sweep      string
+}
+
+// generic mount flags that are passed on to the kernel
+var kernelopts = []string{
+	"suid", "nosuid", "dev", "nodev", "exec", "noexec",
+	"atime", "noatime", "relatime", "sync", "async", "dirsync",
+}
+
+func defaultoptions() *Options {
+	opts := new(Options)
+	opts.logfile = "/tmp/constor.log." + strconv.Itoa(os.Getpid())
+	opts.entrytimeout = 1000 * time.Second
+	opts.attrtimeout = 1000 * time.Second
+	opts.allowother = true
+	opts.defaultperms = true
+	opts.nonempty = true
+	opts.whiteout = WHITEOUT_LEGACY
+	return opts
+}
+
+// optlist collects repeated -o flags
+type optlist []string
+
+func (o *optlist) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *optlist) Set(s string) error {
+	*o = append(*o, s)
+	return nil
+}
+
+func splitlist(s string) []string {
+	list := []string{}
+	for _, e := range strings.Split(s, ":") {
+		if e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+func parsetimeout(key string, val string) (time.Duration, error) {
+	secs, err := strconv.ParseFloat(val, 64)
+	if err != nil || secs < 0 {
+		return 0, fmt.Errorf("%s must be a positive number of seconds, got %q", key, val)
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+func (opts *Options) set(opt string) error {
+	key := opt
+	val := ""
+	hasval := false
+	if i := strings.Index(opt, "="); i >= 0 {
+		key = opt[:i]
+		val = opt[i+1:]
+		hasval = true
+	}
+	var err error
+	switch key {
+	case "layers":
+		opts.layers = splitlist(val)
+	case "log":
+		opts.logfile = val
+	case "entry_timeout":
+		opts.entrytimeout, err = parsetimeout(key, val)
+	case "attr_timeout":
+		opts.attrtimeout, err = parsetimeout(key, val)
+	case "whiteout":
+		opts.whiteout = val
+	case "xattr_allow":
+		opts.xattrallow = splitlist(val)
+	case "xattr_deny":
+		opts.xattrdeny = splitlist(val)
+	case "pidfile":
+		opts.pidfile = val
+	case "ctl":
+		opts.ctl = val
+	case "metrics":
+		opts.metrics = val
+	case "trace":
+		opts.trace = val
+	case "sweep":
+		if val != SWEEP_QUARANTINE && val != SWEEP_REMOVE {
+			return fmt.Errorf("sweep must be %s or %s, got %q", SWEEP_QUARANTINE, SWEEP_REMOVE, val)
+		}
+		opts.sweep = val
+	case "loglevel":
+		opts.loglevel, err = parseloglevel(val)
+	case "logformat":
+		if val != "text" && val != "json" {
+			return fmt.Errorf("logformat must be text or json, got %q", val)
+		}
+		opts.logjson = val == "json"
+	case "logops":
+		opts.logops = splitlist(val)
+	default:
+		if hasval {
+			return fmt.Errorf("unknown option %q", opt)
+		}
+		switch key {
+		case "allow_other":
+			opts.allowother = true
+		case "noallow_other":
+			opts.allowother = false
+		case "default_permissions":
+			opts.defaultperms = true
+		case "nodefault_permissions":
+			opts.defaultperms = false
+		case "nonempty":
+			opts.nonempty = true
+		case "ro":
+			opts.readonly = true
+		case "rw":
+			opts.readonly = false
+		case "debug":
+			opts.debug = true
+			opts.loglevel = LOG_DEBUG
+		case "daemon":
+			opts.daemon = true
+			opts.foreground = false
+		case "foreground":
+			opts.daemon = false
+			opts.foreground = true
+		default:
+			for _, kopt := range kernelopts {
+				if key == kopt {
+					opts.mountopts = append(opts.mountopts, key)
+					return nil
+				}
+			}
+			return fmt.Errorf("unknown option %q", opt)
+		}
+		return nil
+	}
+	if !hasval || (val == "" && key != "xattr_allow" && key != "xattr_deny") {
+		return fmt.Errorf("option %s needs a value", key)
+	}
+	return err
+}
+
+func (opts *Options) validatelayers() error {
+	if len(opts.layers) == 0 {
+		return errors.New("no layers given")
+	}
+	for _, layer := range opts.layers {
+		fi, err := os.Stat(layer)
+		if err != nil {
+			return fmt.Errorf("layer %s : %s", layer, err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("layer %s is not a directory", layer)
+		}
+	}
+	if opts.whiteout != WHITEOUT_LEGACY && opts.whiteout != WHITEOUT_STRICT {
+		return fmt.Errorf("whiteout must be %s or %s, got %q", WHITEOUT_LEGACY, WHITEOUT_STRICT, opts.whiteout)
+	}
+	return nil
+}
+
+func (opts *Options) validate() error {
+	if err := opts.validatelayers(); err != nil {
+		return err
+	}
+	fi, err := os.Stat(opts.mountpoint)
+	if err != nil {
+		return fmt.Errorf("mount point %s : %s", opts.mountpoint, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("mount point %s is not a directory", opts.mountpoint)
+	}
+	return nil
+}
+
+// parses the command line, flags and positional arguments may be mixed.
+// Returns flag.ErrHelp when help was asked for.
+func parseoptions(args []string) (*Options, error) {
+	opts := defaultoptions()
+	var o optlist
+	flags := flag.NewFlagSet("constor", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.Var(&o, "o", "")
+	debug := flags.Bool("d", false, "")
+	readonly := flags.Bool("r", false, "")
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	for _, opt := range o {
+		for _, opt := range strings.Split(opt, ",") {
+			if opt == "" {
+				continue
+			}
+			if err := opts.set(opt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if *debug {
+		opts.debug = true
+		opts.loglevel = LOG_DEBUG
+	}
+	if *readonly {
+		opts.readonly = true
+	}
+	if len(opts.layers) == 0 && len(positional) > 0 {
+		opts.layers = splitlist(positional[0])
+		positional = positional[1:]
+	}
+	if len(positional) != 1 {
+		return nil, errors.New("expected the layers and a mount point")
+	}
+	opts.mountpoint = positional[0]
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	Path "path"
+	"sync"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// creates the file name in the root of the lower layer
+func mklowerfile(t *testing.T, constor *Constor, name string) {
+	id := newuuid().String()
+	if err := ioutil.WriteFile(constor.getPath(1, id), []byte("lower data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entrypath := Path.Join(constor.getPath(1, ROOTID), name)
+	if err := ioutil.WriteFile(entrypath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Lsetxattr(entrypath, IDXATTR, []byte(id), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runs opens, writes, truncates, chmods, creates, renames and unlinks from
+// many goroutines at once, all of them copying up the same lower files.
+// Meant to be run with go test -race.
+func TestRaceStress(t *testing.T) {
+	needroot(t)
+	constor := newtestconstor(t, WHITEOUT_LEGACY)
+	defer removetestconstor(constor)
+	if err := os.Mkdir(constor.getPath(1, ROOTID), 0755); err != nil {
+		t.Fatal(err)
+	}
+	const files = 4
+	for i := 0; i < files; i++ {
+		mklowerfile(t, constor, fmt.Sprintf("lower%d", i))
+	}
+
+	root := fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+	var a, b fuse.EntryOut
+	if code := constor.Mkdir(&fuse.MkdirIn{InHeader: root, Mode: 0755}, "a", &a); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := constor.Mkdir(&fuse.MkdirIn{InHeader: root, Mode: 0755}, "b", &b); !code.Ok() {
+		t.Fatal(code)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 40; i++ {
+				name := fmt.Sprintf("lower%d", (g+i)%files)
+				var e fuse.EntryOut
+				if code := constor.Lookup(&root, name, &e); !code.Ok() {
+					t.Errorf("Lookup %s : %s", name, code)
+					return
+				}
+				h := fuse.InHeader{NodeId: e.NodeId}
+				if g%4 == 3 {
+					// a path chmod copies up as well
+					in := &fuse.SetAttrIn{}
+					in.InHeader = h
+					in.Valid = fuse.FATTR_MODE
+					in.Mode = 0640
+					if code := constor.SetAttr(in, &fuse.AttrOut{}); !code.Ok() {
+						t.Errorf("SetAttr %s : %s", name, code)
+					}
+					constor.Forget(e.NodeId, 1)
+					continue
+				}
+				var o fuse.OpenOut
+				if code := constor.Open(&fuse.OpenIn{InHeader: h, Flags: uint32(os.O_RDWR)}, &o); !code.Ok() {
+					t.Errorf("Open %s : %s", name, code)
+					constor.Forget(e.NodeId, 1)
+					return
+				}
+				constor.Read(&fuse.ReadIn{InHeader: h, Fh: o.Fh, Size: 10}, make([]byte, 10))
+				if _, code := constor.Write(&fuse.WriteIn{InHeader: h, Fh: o.Fh, Offset: uint64(g), Size: 1}, []byte{'x'}); !code.Ok() {
+					t.Errorf("Write %s : %s", name, code)
+				}
+				in := &fuse.SetAttrIn{}
+				in.InHeader = h
+				in.Valid = fuse.FATTR_FH | fuse.FATTR_SIZE
+				in.Fh = o.Fh
+				in.Size = uint64(16 + g)
+				if code := constor.SetAttr(in, &fuse.AttrOut{}); !code.Ok() {
+					t.Errorf("SetAttr %s : %s", name, code)
+				}
+				constor.GetAttr(&fuse.GetAttrIn{InHeader: h}, &fuse.AttrOut{})
+				constor.Release(&fuse.ReleaseIn{Fh: o.Fh})
+				constor.Forget(e.NodeId, 1)
+
+				// creates and renames between a and b in both directions
+				src, dst := a.NodeId, b.NodeId
+				if g%2 == 1 {
+					src, dst = dst, src
+				}
+				name = fmt.Sprintf("f%d_%d", g, i)
+				var c fuse.CreateOut
+				if code := constor.Create(&fuse.CreateIn{InHeader: fuse.InHeader{NodeId: src}, Flags: uint32(os.O_RDWR), Mode: 0644}, name, &c); !code.Ok() {
+					t.Errorf("Create %s : %s", name, code)
+					continue
+				}
+				constor.Write(&fuse.WriteIn{InHeader: fuse.InHeader{NodeId: c.NodeId}, Fh: c.Fh, Size: 1}, []byte{'y'})
+				if code := constor.Rename(&fuse.RenameIn{InHeader: fuse.InHeader{NodeId: src}, Newdir: dst}, name, name+"r"); !code.Ok() {
+					t.Errorf("Rename %s : %s", name, code)
+				}
+				if code := constor.Unlink(&fuse.InHeader{NodeId: dst}, name+"r"); !code.Ok() {
+					t.Errorf("Unlink %s : %s", name, code)
+				}
+				// still open while unlinked
+				constor.Write(&fuse.WriteIn{InHeader: fuse.InHeader{NodeId: c.NodeId}, Fh: c.Fh, Offset: 1, Size: 1}, []byte{'z'})
+				constor.Release(&fuse.ReleaseIn{Fh: c.Fh})
+				constor.Forget(c.NodeId, 1)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i := 0; i < files; i++ {
+		name := fmt.Sprintf("lower%d", i)
+		id, err := constor.getid(-1, ROOTID, name)
+		if err != nil {
+			t.Fatalf("%s : %s", name, err)
+		}
+		if li := constor.getLayer(id); li != 0 {
+			t.Errorf("%s is in layer %d after copyup", name, li)
+		}
+	}
+	for _, dir := range []string{"a", "b"} {
+		id, err := constor.getid(-1, ROOTID, dir)
+		if err != nil {
+			t.Fatalf("%s : %s", dir, err)
+		}
+		if !constor.dirempty(id) {
+			t.Errorf("%s is not empty", dir)
+		}
+	}
+	if _, err := os.Lstat(Path.Join(constor.layers[0], ORPHANDIR)); err == nil {
+		names, _ := ioutil.ReadDir(Path.Join(constor.layers[0], ORPHANDIR))
+		if len(names) != 0 {
+			t.Errorf("%d orphans left", len(names))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func nlookup(inode *Inode) uint64 {
+	inode.Lock()
+	defer inode.Unlock()
+	return inode.nlookup
+}
+
+// "." and ".." come back without a NodeId and take no lookup reference,
+// every other entry takes exactly one
+func TestReadDirPlusLookups(t *testing.T) {
+	needroot(t)
+	constor := newtestconstor(t, WHITEOUT_LEGACY)
+	defer removetestconstor(constor)
+
+	root := fuse.InHeader{NodeId: fuse.FUSE_ROOT_ID}
+	var d fuse.EntryOut
+	if code := constor.Mkdir(&fuse.MkdirIn{InHeader: root, Mode: 0755}, "d", &d); !code.Ok() {
+		t.Fatal(code)
+	}
+	dh := fuse.InHeader{NodeId: d.NodeId}
+	var f fuse.CreateOut
+	if code := constor.Create(&fuse.CreateIn{InHeader: dh, Flags: uint32(os.O_RDWR), Mode: 0644}, "f", &f); !code.Ok() {
+		t.Fatal(code)
+	}
+	constor.Release(&fuse.ReleaseIn{Fh: f.Fh})
+	constor.Forget(f.NodeId, 1)
+
+	rootinode := constor.inodemap.findInodeId(ROOTID)
+	dinode := constor.inodemap.findInodePtr(d.NodeId)
+	rootlookups, dlookups := nlookup(rootinode), nlookup(dinode)
+
+	var o fuse.OpenOut
+	if code := constor.OpenDir(&fuse.OpenIn{InHeader: dh}, &o); !code.Ok() {
+		t.Fatal(code)
+	}
+	list := fuse.NewDirEntryList(make([]byte, 4096), 0)
+	if code := constor.ReadDirPlus(&fuse.ReadIn{InHeader: dh, Fh: o.Fh, Size: 4096}, list); !code.Ok() {
+		t.Fatal(code)
+	}
+	constor.ReleaseDir(&fuse.ReleaseIn{Fh: o.Fh})
+
+	if n := nlookup(dinode); n != dlookups {
+		t.Errorf(". took %d lookups", n-dlookups)
+	}
+	if n := nlookup(rootinode); n != rootlookups {
+		t.Errorf(".. took %d lookups", n-rootlookups)
+	}
+	fid, err := constor.getid(-1, dinode.id, "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	finode := constor.inodemap.findInodeId(fid)
+	if finode == nil {
+		t.Fatal("f was not looked up")
+	}
+	if n := nlookup(finode); n != 1 {
+		t.Fatalf("f has %d lookups", n)
+	}
+	constor.Forget(uint64(uintptr(unsafe.Pointer(finode))), 1)
+	if constor.inodemap.findInodeId(fid) != nil {
+		t.Error("f is still hashed after its forget")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"os"
+	Path "path"
+	"strings"
+	"syscall"
+)
+
+// The last unlink of a layer0 object moves it to ORPHANDIR, it is only
+// removed once no open file or inode refers to it any more, see
+// reclaimorphan. A crash can still leave an entry whose object was never
+// created, or an object that lost its last entry. sweep finds both.
+
+// unreferenced objects are quarantined here unless sweep removes them
+const LOSTDIR = ".constor.lost"
+
+const (
+	SWEEP_QUARANTINE = "quarantine"
+	SWEEP_REMOVE     = "remove"
+)
+
+type sweepreport struct {
+	// objects of layer0 no entry refers to
+	Objects []string `json:"objects"`
+	// entries of layer0 whose object is in no layer, as parentid/name
+	Entries []string `json:"entries"`
+}
+
+// moves the object of id out of the way once its last entry is gone, it
+// is still open or looked up for all we know
+func (constor *Constor) orphanobject(id string) error {
+	dst := constor.orphanPath(id)
+	err := os.Mkdir(Path.Dir(dst), 0700)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	return os.Rename(constor.getPath(0, id), dst)
+}
+
+// removes the orphan object of id once no open file or inode refers to it
+func (constor *Constor) reclaimorphan(id string) {
+	if constor.inodemap.findInodeId(id) != nil {
+		return
+	}
+	if len(constor.fdsof(id)) != 0 {
+		return
+	}
+	// orphans are never directories
+	path := constor.orphanPath(id)
+	err := os.Remove(path)
+	if err == nil {
+		constor.log("reclaimed orphan %s", id)
+	} else if !os.IsNotExist(err) {
+		constor.error("unable to remove %s : %s", path, err)
+	}
+}
+
+// the entries of the merged view of directory id to the ids they point to
+func (constor *Constor) direntryids(id string) map[string]string {
+	names := map[string]bool{}
+	ids := map[string]string{}
+	for li, _ := range constor.layers {
+		path := constor.getPath(li, id)
+		if constor.isdeleted(path, nil) {
+			break
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			// not copied up to this layer, look in the lower ones
+			continue
+		}
+		entries, _ := f.Readdirnames(0)
+		f.Close()
+		for _, name := range entries {
+			if names[name] {
+				// skip if the file was in upper layer
+				continue
+			}
+			names[name] = true
+			entrypath := Path.Join(path, name)
+			if constor.isdeleted(entrypath, nil) {
+				continue
+			}
+			eid, err := Lgetxattr(entrypath, IDXATTR)
+			if err != nil || len(eid) == 0 {
+				continue
+			}
+			ids[name] = string(eid)
+		}
+	}
+	return ids
+}
+
+// walks the directory tree from ROOTID across all layers and deals with
+// what no entry refers to and with entries of layer0 that refer to
+// nothing. Objects and directories in use are left alone, so it may run on
+// a live mount. A rename running at the same time can hide an entry, the
+// objects involved are looked up then and skipped.
+func (constor *Constor) sweep(mode string) (*sweepreport, error) {
+	report := &sweepreport{Objects: []string{}, Entries: []string{}}
+	if constor.readonly {
+		return report, syscall.EROFS
+	}
+	// an object is created after its entry, everything listed here that
+	// is referenced at all is found by the walk below
+	f, err := os.Open(constor.layers[0])
+	if err != nil {
+		return report, err
+	}
+	objects, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		return report, err
+	}
+
+	seen := map[string]bool{ROOTID: true}
+	queue := []string{ROOTID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		dir := constor.inodemap.findInodeId(id)
+		if dir != nil {
+			// keeps out Create and Mkdir between their entry and object
+			dir.dirmu.Lock()
+		}
+		entries := constor.direntryids(id)
+		for name, eid := range entries {
+			if constor.getLayer(eid) == -1 {
+				entrypath := Path.Join(constor.getPath(0, id), name)
+				if _, err := Lgetxattr(entrypath, IDXATTR); err != nil {
+					// the entry is in a lower layer
+					continue
+				}
+				if err := constor.dropentry(id, name); err != nil {
+					constor.error("unable to remove %s : %s", entrypath, err)
+					continue
+				}
+				constor.info("removed entry %s/%s of missing object %s", id, name, eid)
+				report.Entries = append(report.Entries, id+"/"+name)
+				continue
+			}
+			if seen[eid] {
+				continue
+			}
+			seen[eid] = true
+			if ftype, err := constor.idtype(eid); err == nil && ftype == syscall.S_IFDIR {
+				queue = append(queue, eid)
+			}
+		}
+		if dir != nil {
+			dir.dirmu.Unlock()
+		}
+	}
+
+	for _, id := range objects {
+		if seen[id] || id == ORPHANDIR || id == LOSTDIR || strings.HasPrefix(id, TMPPREFIX) {
+			continue
+		}
+		if constor.inodemap.findInodeId(id) != nil || len(constor.fdsof(id)) != 0 {
+			continue
+		}
+		path := constor.getPath(0, id)
+		if constor.isdeleted(path, nil) {
+			// whiteouts of lower layer objects
+			continue
+		}
+		if err := constor.loseobject(id, mode); err != nil {
+			constor.error("unable to %s %s : %s", mode, path, err)
+			continue
+		}
+		report.Objects = append(report.Objects, id)
+	}
+	return report, nil
+}
+
+// removes the layer0 entry name of directory id, a whiteout takes its
+// place when a lower layer still has the name
+func (constor *Constor) dropentry(id string, name string) error {
+	entrypath := Path.Join(constor.getPath(0, id), name)
+	if err := os.RemoveAll(entrypath); err != nil {
+		return err
+	}
+	if _, err := constor.getid(-1, id, name); err == nil {
+		return constor.setdeleted(entrypath)
+	}
+	return nil
+}
+
+// quarantines or removes the unreferenced layer0 object id
+func (constor *Constor) loseobject(id string, mode string) error {
+	path := constor.getPath(0, id)
+	if mode == SWEEP_REMOVE {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		constor.info("removed unreferenced object %s", id)
+		return nil
+	}
+	err := os.Mkdir(Path.Join(constor.layers[0], LOSTDIR), 0700)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := os.Rename(path, Path.Join(constor.layers[0], LOSTDIR, id)); err != nil {
+		return err
+	}
+	constor.info("quarantined unreferenced object %s", id)
+	return nil
+}
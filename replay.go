@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+const REPLAYUSAGE = `Usage: constor replay [-v] [-n COUNT] [-o opt[,opt...]] TRACE /layer0:/layer1:....:/layerN
+
+Re-executes the operations of a trace written with -o trace=PATH against
+the given layers, without mounting them. Use a copy of the layers the
+trace was recorded on. Operations whose status differs from the traced
+one are reported, the exit status is 1 if there are any.
+
+Options:
+  -v          print every operation
+  -n COUNT    stop after COUNT operations, for bisecting
+  -o opts     mount options, only those about layers and logging apply
+              (default log=-)
+
+Written file data is not in the trace, writes are replayed with zeros.
+`
+
+// Replayer maps the node IDs and file handles of a trace onto the ones of
+// the replaying constor
+type Replayer struct {
+	constor *Constor
+	nodes   map[uint64]uint64
+	fhs     map[uint64]uint64
+}
+
+func NewReplayer(constor *Constor) *Replayer {
+	replayer := new(Replayer)
+	replayer.constor = constor
+	replayer.nodes = map[uint64]uint64{1: 1}
+	replayer.fhs = make(map[uint64]uint64)
+	return replayer
+}
+
+// nodes handed out by ReadDirPlus are not in the trace, those are found
+// by their constor ID, which only differs for objects the trace created
+func (replayer *Replayer) node(traced uint64, id string) (uint64, error) {
+	if traced == 0 {
+		return 0, nil
+	}
+	if n, ok := replayer.nodes[traced]; ok {
+		return n, nil
+	}
+	if id != "" {
+		if inode := replayer.constor.inodemap.findInodeId(id); inode != nil {
+			return nodeid(inode), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown node %d (%s)", traced, id)
+}
+
+func (replayer *Replayer) fh(fh uint64) (uint64, error) {
+	if n, ok := replayer.fhs[fh]; ok {
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown file handle %d", fh)
+}
+
+func (replayer *Replayer) header(rec *tracerecord) (fuse.InHeader, error) {
+	header := fuse.InHeader{}
+	node, err := replayer.node(rec.Node, rec.Id)
+	if err != nil {
+		return header, err
+	}
+	header.NodeId = node
+	header.Uid = rec.Uid
+	header.Gid = rec.Gid
+	header.Pid = rec.Pid
+	return header, nil
+}
+
+func (replayer *Replayer) mapnode(rec *tracerecord, out uint64) {
+	if rec.OutNode != 0 && out != 0 {
+		replayer.nodes[rec.OutNode] = out
+	}
+}
+
+func (replayer *Replayer) mapfh(rec *tracerecord, out uint64) {
+	if rec.OutFh != 0 && out != 0 {
+		replayer.fhs[rec.OutFh] = out
+	}
+}
+
+// runs one traced operation, an error means it could not be replayed
+func (replayer *Replayer) run(rec *tracerecord) (fuse.Status, error) {
+	constor := replayer.constor
+	header, err := replayer.header(rec)
+	if err != nil {
+		return fuse.OK, err
+	}
+	var fh uint64
+	if rec.Fh != 0 && (rec.Op != "SetAttr" || rec.Valid&fuse.FATTR_FH != 0) {
+		if fh, err = replayer.fh(rec.Fh); err != nil {
+			return fuse.OK, err
+		}
+	}
+	node2, err := replayer.node(rec.Node2, rec.Id2)
+	if err != nil {
+		return fuse.OK, err
+	}
+	var code fuse.Status
+	switch rec.Op {
+	case "Lookup":
+		out := fuse.EntryOut{}
+		code = constor.Lookup(&header, rec.Name, &out)
+		replayer.mapnode(rec, out.NodeId)
+	case "Forget":
+		constor.Forget(header.NodeId, rec.Size)
+	case "GetAttr":
+		input := fuse.GetAttrIn{InHeader: header, Flags_: rec.Flags, Fh_: fh}
+		code = constor.GetAttr(&input, &fuse.AttrOut{})
+	case "SetAttr":
+		input := fuse.SetAttrIn{}
+		input.InHeader = header
+		input.Valid = rec.Valid
+		input.Fh = fh
+		input.Size = rec.Size
+		input.Mode = rec.Mode
+		input.Uid = rec.AttrUid
+		input.Gid = rec.AttrGid
+		input.Atime = rec.Atime
+		input.Atimensec = rec.Atimensec
+		input.Mtime = rec.Mtime
+		input.Mtimensec = rec.Mtimensec
+		code = constor.SetAttr(&input, &fuse.AttrOut{})
+	case "Mknod":
+		out := fuse.EntryOut{}
+		code = constor.Mknod(&fuse.MknodIn{InHeader: header, Mode: rec.Mode, Rdev: rec.Rdev}, rec.Name, &out)
+		replayer.mapnode(rec, out.NodeId)
+	case "Mkdir":
+		out := fuse.EntryOut{}
+		code = constor.Mkdir(&fuse.MkdirIn{InHeader: header, Mode: rec.Mode}, rec.Name, &out)
+		replayer.mapnode(rec, out.NodeId)
+	case "Unlink":
+		code = constor.Unlink(&header, rec.Name)
+	case "Rmdir":
+		code = constor.Rmdir(&header, rec.Name)
+	case "Rename":
+		code = constor.Rename(&fuse.RenameIn{InHeader: header, Newdir: node2, Flags: rec.Flags}, rec.Name, rec.Name2)
+	case "Link":
+		out := fuse.EntryOut{}
+		code = constor.Link(&fuse.LinkIn{InHeader: header, Oldnodeid: node2}, rec.Name, &out)
+		replayer.mapnode(rec, out.NodeId)
+	case "Symlink":
+		out := fuse.EntryOut{}
+		code = constor.Symlink(&header, rec.Name2, rec.Name, &out)
+		replayer.mapnode(rec, out.NodeId)
+	case "Readlink":
+		_, code = constor.Readlink(&header)
+	case "Access":
+		code = constor.Access(&fuse.AccessIn{InHeader: header, Mask: rec.Flags})
+	case "GetXAttrSize":
+		_, code = constor.GetXAttrSize(&header, rec.Name)
+	case "GetXAttrData":
+		_, code = constor.GetXAttrData(&header, rec.Name)
+	case "ListXAttr":
+		_, code = constor.ListXAttr(&header)
+	case "SetXAttr":
+		input := fuse.SetXAttrIn{InHeader: header, Size: uint32(len(rec.Data)), Flags: rec.Flags}
+		code = constor.SetXAttr(&input, rec.Name, rec.Data)
+	case "RemoveXAttr":
+		code = constor.RemoveXAttr(&header, rec.Name)
+	case "Create":
+		out := fuse.CreateOut{}
+		code = constor.Create(&fuse.CreateIn{InHeader: header, Flags: rec.Flags, Mode: rec.Mode}, rec.Name, &out)
+		replayer.mapnode(rec, out.NodeId)
+		replayer.mapfh(rec, out.Fh)
+	case "Open":
+		out := fuse.OpenOut{}
+		code = constor.Open(&fuse.OpenIn{InHeader: header, Flags: rec.Flags}, &out)
+		replayer.mapfh(rec, out.Fh)
+	case "Read":
+		buf := make([]byte, rec.Size)
+		var res fuse.ReadResult
+		res, code = constor.Read(&fuse.ReadIn{InHeader: header, Fh: fh, Offset: rec.Off, Size: uint32(rec.Size)}, buf)
+		if res != nil {
+			// results backed by an fd only read here
+			_, code = res.Bytes(buf)
+			res.Done()
+		}
+	case "Release":
+		constor.Release(&fuse.ReleaseIn{InHeader: header, Fh: fh, Flags: rec.Flags})
+		delete(replayer.fhs, rec.Fh)
+	case "Write":
+		input := fuse.WriteIn{InHeader: header, Fh: fh, Offset: rec.Off, Size: uint32(rec.Size)}
+		_, code = constor.Write(&input, make([]byte, rec.Size))
+	case "Flush":
+		code = constor.Flush(&fuse.FlushIn{InHeader: header, Fh: fh})
+	case "Fsync":
+		code = constor.Fsync(&fuse.FsyncIn{InHeader: header, Fh: fh, FsyncFlags: rec.Flags})
+	case "Fallocate":
+		code = constor.Fallocate(&fuse.FallocateIn{InHeader: header, Fh: fh, Offset: rec.Off, Length: rec.Size, Mode: rec.Mode})
+	case "OpenDir":
+		out := fuse.OpenOut{}
+		code = constor.OpenDir(&fuse.OpenIn{InHeader: header, Flags: rec.Flags}, &out)
+		replayer.mapfh(rec, out.Fh)
+	case "ReadDir":
+		out := fuse.NewDirEntryList(make([]byte, rec.Size), rec.Off)
+		code = constor.ReadDir(&fuse.ReadIn{InHeader: header, Fh: fh, Offset: rec.Off, Size: uint32(rec.Size)}, out)
+	case "ReadDirPlus":
+		out := fuse.NewDirEntryList(make([]byte, rec.Size), rec.Off)
+		code = constor.ReadDirPlus(&fuse.ReadIn{InHeader: header, Fh: fh, Offset: rec.Off, Size: uint32(rec.Size)}, out)
+	case "ReleaseDir":
+		constor.ReleaseDir(&fuse.ReleaseIn{InHeader: header, Fh: fh, Flags: rec.Flags})
+		delete(replayer.fhs, rec.Fh)
+	case "FsyncDir":
+		code = constor.FsyncDir(&fuse.FsyncIn{InHeader: header, Fh: fh, FsyncFlags: rec.Flags})
+	case "StatFs":
+		code = constor.StatFs(&header, &fuse.StatfsOut{})
+	default:
+		return fuse.OK, fmt.Errorf("unknown operation %s", rec.Op)
+	}
+	return code, nil
+}
+
+func replaymain(args []string) int {
+	opts := defaultoptions()
+	opts.logfile = "-"
+	var o optlist
+	flags := flag.NewFlagSet("constor replay", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.Var(&o, "o", "")
+	verbose := flags.Bool("v", false, "")
+	count := flags.Int("n", -1, "")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Print(REPLAYUSAGE)
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "constor replay: %s\n\n%s", err, REPLAYUSAGE)
+		return 1
+	}
+	for _, opt := range o {
+		for _, opt := range strings.Split(opt, ",") {
+			if opt == "" {
+				continue
+			}
+			if err := opts.set(opt); err != nil {
+				fmt.Fprintf(os.Stderr, "constor replay: %s\n", err)
+				return 1
+			}
+		}
+	}
+	args = flags.Args()
+	if len(opts.layers) == 0 && len(args) == 2 {
+		opts.layers = splitlist(args[1])
+		args = args[:1]
+	}
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, REPLAYUSAGE)
+		return 1
+	}
+	if err := opts.validatelayers(); err != nil {
+		fmt.Fprintf(os.Stderr, "constor replay: %s\n", err)
+		return 1
+	}
+	tracef, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "constor replay: %s\n", err)
+		return 1
+	}
+	defer tracef.Close()
+	logf, err := openlog(opts.logfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "constor replay: unable to open log %s : %s\n", opts.logfile, err)
+		return 1
+	}
+
+	constor := NewConstor(opts, logf)
+	if err := constor.preparelayers(); err != nil {
+		fmt.Fprintf(os.Stderr, "constor replay: %s\n", err)
+		return 1
+	}
+	// as on a mount, the traced modes already have the umask applied
+	syscall.Umask(000)
+	replayer := NewReplayer(constor)
+	defer constor.closefds()
+
+	ops := 0
+	mismatches := 0
+	skipped := 0
+	scanner := bufio.NewScanner(tracef)
+	// SetXAttr values are up to 64k before encoding
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if ops == *count {
+			break
+		}
+		rec := new(tracerecord)
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			fmt.Fprintf(os.Stderr, "constor replay: %s:%d: %s\n", args[0], line, err)
+			return 1
+		}
+		ops++
+		code, err := replayer.run(rec)
+		what := fmt.Sprintf("%d: %s %s %s", line, rec.Op, rec.Id, rec.Name)
+		if err != nil {
+			skipped++
+			fmt.Printf("%s: skipped, %s\n", what, err)
+			continue
+		}
+		if int32(code) != rec.Status {
+			mismatches++
+			fmt.Printf("%s: traced %s, replayed %s\n", what, fuse.Status(rec.Status), code)
+		} else if *verbose {
+			fmt.Printf("%s: %s\n", what, code)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "constor replay: %s: %s\n", args[0], err)
+		return 1
+	}
+	fmt.Printf("%d operations, %d mismatches, %d skipped\n", ops, mismatches, skipped)
+	if mismatches > 0 {
+		return 1
+	}
+	return 0
+}
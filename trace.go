@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// A trace has one JSON object per line, one per FUSE operation, in the
+// order the operations completed. Node IDs and file handles are the ones
+// the kernel used, the constor IDs they resolved to are kept next to them
+// so that "constor replay" can map them onto a fresh mount. File data is
+// not recorded, only offsets and sizes.
+type tracerecord struct {
+	// start in unix nanoseconds and duration in nanoseconds
+	Time   int64  `json:"t"`
+	Dur    int64  `json:"dur"`
+	Op     string `json:"op"`
+	Status int32  `json:"st"`
+	Uid    uint32 `json:"uid,omitempty"`
+	Gid    uint32 `json:"gid,omitempty"`
+	Pid    uint32 `json:"pid,omitempty"`
+	Node   uint64 `json:"node,omitempty"`
+	Id     string `json:"id,omitempty"`
+	// the new parent of Rename and the linked node of Link
+	Node2 uint64 `json:"node2,omitempty"`
+	Id2   string `json:"id2,omitempty"`
+	Name  string `json:"name,omitempty"`
+	// the new name of Rename and the target of Symlink
+	Name2 string `json:"name2,omitempty"`
+	Flags uint32 `json:"flags,omitempty"`
+	Mode  uint32 `json:"mode,omitempty"`
+	Rdev  uint32 `json:"rdev,omitempty"`
+	Fh    uint64 `json:"fh,omitempty"`
+	Off   uint64 `json:"off,omitempty"`
+	Size  uint64 `json:"size,omitempty"`
+	// SetAttr only
+	Valid     uint32 `json:"valid,omitempty"`
+	AttrUid   uint32 `json:"auid,omitempty"`
+	AttrGid   uint32 `json:"agid,omitempty"`
+	Atime     uint64 `json:"atime,omitempty"`
+	Mtime     uint64 `json:"mtime,omitempty"`
+	Atimensec uint32 `json:"atimensec,omitempty"`
+	Mtimensec uint32 `json:"mtimensec,omitempty"`
+	// the value of SetXAttr
+	Data    []byte `json:"data,omitempty"`
+	OutNode uint64 `json:"onode,omitempty"`
+	OutId   string `json:"oid,omitempty"`
+	OutFh   uint64 `json:"ofh,omitempty"`
+
+	start time.Time
+}
+
+// Tracer appends records to a trace file. All methods are no-ops on a
+// nil *Tracer.
+type Tracer struct {
+	sync.Mutex
+	f *os.File
+}
+
+func NewTracer(path string) (*Tracer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracer{f: f}, nil
+}
+
+// each record goes out in a single write, a trace stays usable up to the
+// operation that crashed constor
+func (tracer *Tracer) write(rec *tracerecord) error {
+	if tracer == nil {
+		return nil
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tracer.Lock()
+	defer tracer.Unlock()
+	_, err = tracer.f.Write(append(buf, '\n'))
+	return err
+}
+
+func (tracer *Tracer) close() error {
+	if tracer == nil {
+		return nil
+	}
+	tracer.Lock()
+	defer tracer.Unlock()
+	return tracer.f.Close()
+}
+
+// the constor ID of a node ID, only looked up when tracing
+func (constor *Constor) traceid(nodeid uint64) string {
+	if constor.tracer == nil || nodeid == 0 {
+		return ""
+	}
+	inode := constor.inodemap.findInodePtr(nodeid)
+	if inode == nil {
+		return ""
+	}
+	return inode.id
+}
+
+// starts the record of an operation on the node in header
+func (constor *Constor) opbegin(op string, header *fuse.InHeader) *tracerecord {
+	rec := &tracerecord{
+		Op:    op,
+		Uid:   header.Uid,
+		Gid:   header.Gid,
+		Pid:   header.Pid,
+		Node:  header.NodeId,
+		Id:    constor.traceid(header.NodeId),
+		start: time.Now(),
+	}
+	rec.Time = rec.start.UnixNano()
+	return rec
+}
+
+// accounts a finished operation and writes it to the trace
+func (constor *Constor) opend(rec *tracerecord, code fuse.Status) {
+	elapsed := time.Since(rec.start)
+	constor.metrics.observe(rec.Op, elapsed, code)
+	if constor.tracer == nil {
+		return
+	}
+	rec.Dur = int64(elapsed)
+	rec.Status = int32(code)
+	if !code.Ok() {
+		rec.OutNode = 0
+		rec.OutFh = 0
+	}
+	rec.OutId = constor.traceid(rec.OutNode)
+	if err := constor.tracer.write(rec); err != nil {
+		constor.error("unable to write trace : %s", err)
+	}
+}
+
+// the node ID the kernel knows an inode by
+func nodeid(inode *Inode) uint64 {
+	if inode.id == ROOTID {
+		return 1
+	}
+	return uint64(uintptr(unsafe.Pointer(inode)))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
     "encoding/hex"
+    "strings"
     gouuid "github.com/satori/go.uuid"
 )
 
@@ -50,3 +51,14 @@ func idtoino(id string) uint64 {
 func newuuid() uuid {
     return uuid(gouuid.NewV4())
 }
+
+// a name based uuid, the same name always gives the same one
+func nameuuid(name string) uuid {
+    return uuid(gouuid.NewV5(gouuid.NamespaceURL, "constor:" + name))
+}
+
+// a uuid for a group of names, in a namespace of its own so that it never
+// equals the nameuuid of a single name
+func groupuuid(names []string) uuid {
+    return uuid(gouuid.NewV5(gouuid.NamespaceOID, "constor:" + strings.Join(names, "\x00")))
+}